@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"unicode"
+)
+
+const defaultBatchConcurrency = 4
+
+// mapBatchRequest maps a JSON array or a stream of newline delimited native videos.
+// The results are streamed back as newline delimited JSON as soon as each document is mapped, so they may not keep the input order.
+func (h serviceHandler) mapBatchRequest(w http.ResponseWriter, r *http.Request) {
+	tid := r.Header.Get("X-Request-Id")
+
+	_, profile, err := h.originProfile(r)
+	if err != nil {
+		writeProblem(w, err, tid, h.log)
+		return
+	}
+
+	lastModified, err := normaliseTimestamp(r.Header.Get("Message-Timestamp"))
+	if err != nil {
+		writeProblem(w, err, tid, h.log)
+		return
+	}
+
+	concurrency := h.batchConcurrency
+	if concurrency < 1 {
+		concurrency = defaultBatchConcurrency
+	}
+
+	// Results are written while the request body is still being read.
+	_ = http.NewResponseController(w).EnableFullDuplex()
+
+	results := make(chan BatchResult)
+	go func() {
+		defer close(results)
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, concurrency)
+		err := forEachBatchDocument(r.Body, func(index int, doc json.RawMessage) {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				results <- h.mapBatchDocument(index, doc, tid, lastModified, profile)
+			}()
+		})
+		wg.Wait()
+		if err != nil {
+			results <- BatchResult{Index: err.index, Error: err.Error(), Code: errCodeInvalidJSON}
+		}
+	}()
+
+	w.Header().Add("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for result := range results {
+		if err := enc.Encode(result); err != nil {
+			h.log.WithError(err).WithTransactionID(tid).Error("Writing response error.")
+			continue
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func (h serviceHandler) mapBatchDocument(index int, doc json.RawMessage, tid, lastModified string, profile originProfile) BatchResult {
+	m := relatedContentMapper{sc: h.sc, strContent: string(doc), tid: tid, lastModified: lastModified, profile: profile, log: h.log}
+	content, err := h.mapRelatedContentRequest(&m)
+	if err != nil {
+		code, field := errorCode(err)
+		return BatchResult{Index: index, Error: err.Error(), Code: code, Field: field, Violations: errorViolations(err)}
+	}
+	return BatchResult{Index: index, Content: content}
+}
+
+// batchDecodeError reports the document of a batch that could not be read. The following documents are not read.
+type batchDecodeError struct {
+	index int
+	err   error
+}
+
+func (e *batchDecodeError) Error() string {
+	return fmt.Sprintf("document %d of the batch couldn't be read: %v", e.index, e.err)
+}
+
+// forEachBatchDocument calls fn with each document of a JSON array or of a stream of JSON documents.
+func forEachBatchDocument(body io.Reader, fn func(index int, doc json.RawMessage)) *batchDecodeError {
+	br := bufio.NewReader(body)
+	isArray := false
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &batchDecodeError{index: 0, err: err}
+		}
+		if !unicode.IsSpace(rune(b)) {
+			isArray = b == '['
+			_ = br.UnreadByte()
+			break
+		}
+	}
+
+	dec := json.NewDecoder(br)
+	if isArray {
+		if _, err := dec.Token(); err != nil {
+			return &batchDecodeError{index: 0, err: err}
+		}
+	}
+
+	for index := 0; ; index++ {
+		if isArray && !dec.More() {
+			return nil
+		}
+		var doc json.RawMessage
+		err := dec.Decode(&doc)
+		if err == io.EOF && !isArray {
+			return nil
+		}
+		if err != nil {
+			return &batchDecodeError{index: index, err: err}
+		}
+		fn(index, doc)
+	}
+}
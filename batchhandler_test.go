@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapBatchRequest(t *testing.T) {
+	video := strings.TrimSpace(string(getBytes("next-video-input.json", t)))
+	invalidRelated := strings.TrimSpace(string(getBytes("next-video-invalid-related-input.json", t)))
+	expectedContent := newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", "", false)
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedErrors []bool
+	}{
+		{
+			"JSON array",
+			"[" + video + "," + invalidRelated + "," + video + "]",
+			[]bool{false, true, false},
+		},
+		{
+			"NDJSON",
+			video + "\n" + invalidRelated + "\n" + video + "\n",
+			[]bool{false, true, false},
+		},
+		{
+			"truncated NDJSON",
+			video + "\n" + `{"id":`,
+			[]bool{false, true},
+		},
+		{
+			"empty",
+			"  ",
+			[]bool{},
+		},
+	}
+
+	for _, test := range tests {
+		h := serviceHandler{
+			sc:               serviceConfig{},
+			batchConcurrency: 2,
+			log:              logger.NewUPPLogger("video-mapper", "Debug"),
+		}
+		req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/map/batch", strings.NewReader(test.body))
+		req.Header.Set("X-Request-Id", "1234")
+		w := httptest.NewRecorder()
+
+		h.mapBatchRequest(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "HTTP status wrong. Batch: %s", test.name)
+		assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+		results := make([]BatchResult, 0)
+		scanner := bufio.NewScanner(w.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var result BatchResult
+			err := json.Unmarshal(scanner.Bytes(), &result)
+			assert.NoError(t, err, "Batch: %s", test.name)
+			results = append(results, result)
+		}
+		sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+
+		if !assert.Len(t, results, len(test.expectedErrors), "Results wrong. Batch: %s", test.name) {
+			continue
+		}
+		for i, expectedErr := range test.expectedErrors {
+			assert.Equal(t, i, results[i].Index, "Result index wrong. Batch: %s", test.name)
+			assert.Equal(t, expectedErr, results[i].Error != "", "Result error wrong. Batch: %s, index: %d", test.name, i)
+			if !expectedErr {
+				assert.Equal(t, expectedContent, string(results[i].Content), "Result content wrong. Batch: %s, index: %d", test.name, i)
+			}
+		}
+	}
+}
+
+func TestMapBatchRequestMessageTimestamp(t *testing.T) {
+	video := strings.TrimSpace(string(getBytes("next-video-input.json", t)))
+	tests := []struct {
+		name                 string
+		timestamp            string
+		expectedHTTPStatus   int
+		expectedLastModified string
+	}{
+		{"normalised", "1491316978920", http.StatusOK, "2017-04-04T14:42:58.920Z"},
+		{"invalid", "yesterday", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := serviceHandler{
+				sc:  serviceConfig{},
+				log: logger.NewUPPLogger("video-mapper", "Debug"),
+			}
+			req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/map/batch", strings.NewReader(video))
+			req.Header.Set("X-Request-Id", "1234")
+			req.Header.Set("Message-Timestamp", test.timestamp)
+			w := httptest.NewRecorder()
+
+			h.mapBatchRequest(w, req)
+
+			assert.Equal(t, test.expectedHTTPStatus, w.Code)
+			if test.expectedHTTPStatus != http.StatusOK {
+				var problem Problem
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+				assert.Equal(t, errCodeTimestamp, problem.Code)
+				return
+			}
+			var result BatchResult
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+			assert.Equal(t, newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", test.expectedLastModified, false), string(result.Content))
+		})
+	}
+}
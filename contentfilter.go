@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+const (
+	ruleInvalidContentType = "invalid-content-type"
+	ruleNotIncluded        = "not-included"
+)
+
+var defaultContentTypeExcludes = []string{
+	"audio",
+	"audio/*",
+	"application/vnd.ft-upp-audio",
+	"application/vnd.ft-upp-audio+json",
+}
+
+// contentTypeRule matches media types against a pattern with optional wildcards and parameters,
+// e.g. "audio/*" or "application/json; profile=video".
+type contentTypeRule struct {
+	rule      string
+	mediaType string
+	params    map[string]string
+}
+
+func newContentTypeRule(rule string) (contentTypeRule, error) {
+	mediaType, params, err := mime.ParseMediaType(rule)
+	if err != nil {
+		return contentTypeRule{}, fmt.Errorf("invalid content type rule %q: %w", rule, err)
+	}
+	if _, err = path.Match(mediaType, ""); err != nil {
+		return contentTypeRule{}, fmt.Errorf("invalid content type rule %q: %w", rule, err)
+	}
+	return contentTypeRule{rule: rule, mediaType: mediaType, params: params}, nil
+}
+
+func (r contentTypeRule) matches(mediaType string, params map[string]string) bool {
+	if ok, _ := path.Match(r.mediaType, mediaType); !ok {
+		return false
+	}
+	for k, v := range r.params {
+		if !strings.EqualFold(params[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+// contentTypeFilter decides which messages are mapped based on their Content-Type header.
+// A message is dropped if it matches any exclude rule, or if include rules are set and it matches none of them.
+// Messages without a Content-Type are only dropped when include rules are set.
+type contentTypeFilter struct {
+	includes []contentTypeRule
+	excludes []contentTypeRule
+}
+
+func newContentTypeFilter(includes, excludes []string) (*contentTypeFilter, error) {
+	f := &contentTypeFilter{}
+	for _, rule := range includes {
+		r, err := newContentTypeRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		f.includes = append(f.includes, r)
+	}
+	for _, rule := range excludes {
+		r, err := newContentTypeRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		f.excludes = append(f.excludes, r)
+	}
+	return f, nil
+}
+
+// allow reports whether a message with the given Content-Type should be mapped.
+// When it should not, the rule that dropped it is returned.
+func (f *contentTypeFilter) allow(contentType string) (bool, string) {
+	if f == nil {
+		f = defaultContentTypeFilter
+	}
+	if strings.TrimSpace(contentType) == "" {
+		if len(f.includes) > 0 {
+			return false, ruleNotIncluded
+		}
+		return true, ""
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false, ruleInvalidContentType
+	}
+
+	for _, r := range f.excludes {
+		if r.matches(mediaType, params) {
+			return false, r.rule
+		}
+	}
+	if len(f.includes) == 0 {
+		return true, ""
+	}
+	for _, r := range f.includes {
+		if r.matches(mediaType, params) {
+			return true, ""
+		}
+	}
+	return false, ruleNotIncluded
+}
+
+var defaultContentTypeFilter = func() *contentTypeFilter {
+	f, err := newContentTypeFilter(nil, defaultContentTypeExcludes)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}()
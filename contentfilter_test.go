@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentTypeFilterAllow(t *testing.T) {
+	tests := []struct {
+		includes      []string
+		excludes      []string
+		contentType   string
+		expectedAllow bool
+		expectedRule  string
+	}{
+		{nil, defaultContentTypeExcludes, "application/json", true, ""},
+		{nil, defaultContentTypeExcludes, "application/json; charset=utf-8", true, ""},
+		{nil, defaultContentTypeExcludes, "", true, ""},
+		{nil, defaultContentTypeExcludes, "audio", false, "audio"},
+		{nil, defaultContentTypeExcludes, "audio/mpeg", false, "audio/*"},
+		{nil, defaultContentTypeExcludes, "Application/Vnd.FT-UPP-Audio+JSON", false, "application/vnd.ft-upp-audio+json"},
+		{nil, defaultContentTypeExcludes, "application/vnd.ft-upp-audio-transcript+json", true, ""},
+		{nil, defaultContentTypeExcludes, "application/json;;", false, ruleInvalidContentType},
+		{[]string{"application/json", "application/vnd.ft-upp-*"}, nil, "application/vnd.ft-upp-video+json", true, ""},
+		{[]string{"application/json", "application/vnd.ft-upp-*"}, nil, "text/plain", false, ruleNotIncluded},
+		{[]string{"application/json"}, nil, "", false, ruleNotIncluded},
+		{nil, []string{"application/json; profile=audio"}, "application/json; profile=audio", false, "application/json; profile=audio"},
+		{nil, []string{"application/json; profile=audio"}, "application/json; profile=video", true, ""},
+		{nil, []string{"application/json; profile=audio"}, "application/json", true, ""},
+	}
+
+	for _, test := range tests {
+		f, err := newContentTypeFilter(test.includes, test.excludes)
+		assert.NoError(t, err)
+		allow, rule := f.allow(test.contentType)
+		assert.Equal(t, test.expectedAllow, allow, "Allow status is wrong. Content-Type: %s", test.contentType)
+		assert.Equal(t, test.expectedRule, rule, "Rule is wrong. Content-Type: %s", test.contentType)
+	}
+}
+
+func TestNewContentTypeFilterInvalidRules(t *testing.T) {
+	_, err := newContentTypeFilter([]string{"application/["}, nil)
+	assert.Error(t, err)
+	_, err = newContentTypeFilter(nil, []string{""})
+	assert.Error(t, err)
+}
+
+func TestNilContentTypeFilterUsesDefaults(t *testing.T) {
+	var f *contentTypeFilter
+	allow, rule := f.allow("audio/mpeg")
+	assert.False(t, allow)
+	assert.Equal(t, "audio/*", rule)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Financial-Times/kafka-client-go/v3"
+)
+
+const (
+	stageUnmarshal    = "unmarshal"
+	stageHeaders      = "headers"
+	stageValidate     = "validate"
+	stageMap          = "map"
+	stageProduce      = "produce"
+	stageRelationship = "relationship"
+	stageStale        = "stale"
+)
+
+// failureSink receives the messages that could not be processed so they are not silently dropped.
+type failureSink interface {
+	Park(message kafka.FTMessage, stage string, cause error) error
+}
+
+// stageError records the stage of the processing pipeline where an error occurred.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+func newStageError(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stageError{stage: stage, err: err}
+}
+
+// isTransientStage tells whether the failures of a stage can go away when the message is processed again,
+// unlike the ones of the stages before sending that depend only on the message.
+func isTransientStage(stage string) bool {
+	return stage == stageProduce || stage == stageRelationship
+}
+
+func errorStage(err error) string {
+	var se *stageError
+	if errors.As(err, &se) {
+		return se.stage
+	}
+	return stageMap
+}
+
+// deadLetterSink republishes the original message together with the failure details on a dead-letter topic.
+type deadLetterSink struct {
+	messageProducer messageProducer
+}
+
+func (s *deadLetterSink) Park(message kafka.FTMessage, stage string, cause error) error {
+	dl := DeadLetter{
+		Body:     message.Body,
+		Headers:  message.Headers,
+		Reason:   cause.Error(),
+		Stage:    stage,
+		FailedAt: time.Now().UTC().Format(dateFormat),
+	}
+	body, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return s.messageProducer.SendMessage(kafka.FTMessage{Headers: message.Headers, Body: string(body)})
+}
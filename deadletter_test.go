@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterSinkPark(t *testing.T) {
+	mockMsgProducer := mockMessageProducer{}
+	s := deadLetterSink{messageProducer: &mockMsgProducer}
+	headers := createHeaders(nextVideoOrigin, "application/json", "1234", lastModified)
+
+	err := s.Park(kafka.FTMessage{Headers: headers, Body: "invalid content"}, stageUnmarshal, errors.New("invalid JSON"))
+	assert.NoError(t, err)
+	assert.True(t, mockMsgProducer.sendCalled, "Dead letter should be sent")
+
+	var dl DeadLetter
+	err = json.Unmarshal([]byte(mockMsgProducer.message), &dl)
+	assert.NoError(t, err)
+	assert.Equal(t, "invalid content", dl.Body)
+	assert.Equal(t, headers, dl.Headers)
+	assert.Equal(t, "invalid JSON", dl.Reason)
+	assert.Equal(t, stageUnmarshal, dl.Stage)
+	assert.NotEmpty(t, dl.FailedAt)
+}
+
+func TestErrorStage(t *testing.T) {
+	tests := []struct {
+		err           error
+		expectedStage string
+	}{
+		{newStageError(stageUnmarshal, errors.New("test")), stageUnmarshal},
+		{newStageError(stageHeaders, errors.New("test")), stageHeaders},
+		{errors.New("test"), stageMap},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expectedStage, errorStage(test.err), "Stage is wrong. Error: %v", test.err)
+	}
+	assert.Nil(t, newStageError(stageMap, nil))
+}
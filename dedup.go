@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers the items of the story packages last sent, so unchanged story packages are not sent again.
+// It holds up to size story packages, evicting the least recently used, each for ttl after it was sent.
+// When path is set the cache is loaded from and saved to that file, so it survives restarts.
+// A nil *dedupCache remembers nothing.
+type dedupCache struct {
+	ttl     time.Duration
+	path    string
+	now     func() time.Time
+	mu      sync.Mutex
+	entries *lru[dedupEntry]
+}
+
+// dedupEntry is a story package remembered by the cache, as saved to the cache file.
+type dedupEntry struct {
+	Key       string    `json:"key"`
+	Hash      string    `json:"hash"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// newDedupCache creates the cache, loading the entries saved to path if any. A size lower than 1 disables the cache.
+func newDedupCache(size int, ttl time.Duration, path string) (*dedupCache, error) {
+	if size < 1 {
+		return nil, nil
+	}
+	c := &dedupCache{
+		ttl:     ttl,
+		path:    path,
+		now:     time.Now,
+		entries: newLRU[dedupEntry](size),
+	}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []dedupEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	now := c.now()
+	for _, e := range entries {
+		if e.ExpiresAt.After(now) {
+			c.entries.put(e.Key, e)
+		}
+	}
+	return c, nil
+}
+
+// seen tells whether the story package was sent with the same items and hasn't expired yet.
+func (c *dedupCache) seen(key, hash string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries.get(key)
+	if !ok {
+		return false
+	}
+	if !e.ExpiresAt.After(c.now()) {
+		c.entries.remove(key)
+		return false
+	}
+	return e.Hash == hash
+}
+
+// remember records the items of a story package that was sent.
+func (c *dedupCache) remember(key, hash string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries.put(key, dedupEntry{Key: key, Hash: hash, ExpiresAt: c.now().Add(c.ttl)})
+}
+
+// forget removes a story package from the cache, so that it is sent again whatever its items.
+func (c *dedupCache) forget(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries.remove(key)
+}
+
+// save writes the entries to the cache file, least recently used first.
+func (c *dedupCache) save() error {
+	if c == nil || c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	entries := make([]dedupEntry, 0, c.entries.len())
+	c.entries.each(func(_ string, e dedupEntry) {
+		entries = append(entries, e)
+	})
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// storyPackageHash identifies the content of the story package built by a mapping: its items, or its deletion.
+func storyPackageHash(m *relatedContentMapper) (string, error) {
+	data, err := json.Marshal(struct {
+		Items   []Item `json:"items"`
+		Deleted bool   `json:"deleted"`
+	}{m.relatedItems, m.deleted})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
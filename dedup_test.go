@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestDedupCache(t *testing.T, size int, path string) (*dedupCache, *fakeClock) {
+	c, err := newDedupCache(size, time.Minute, path)
+	assert.NoError(t, err)
+	clock := &fakeClock{now: time.Now()}
+	c.now = clock.Now
+	return c, clock
+}
+
+func TestDedupCacheSeen(t *testing.T) {
+	c, clock := newTestDedupCache(t, 2, "")
+
+	assert.False(t, c.seen("a", "1"), "Unknown story package should not be seen")
+	c.remember("a", "1")
+	assert.True(t, c.seen("a", "1"), "Unchanged story package should be seen")
+	assert.False(t, c.seen("a", "2"), "Changed story package should not be seen")
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.False(t, c.seen("a", "1"), "Expired story package should not be seen")
+	assert.Equal(t, 0, c.entries.len(), "Expired story package should be evicted")
+}
+
+func TestDedupCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c, _ := newTestDedupCache(t, 2, "")
+
+	c.remember("a", "1")
+	c.remember("b", "1")
+	assert.True(t, c.seen("a", "1"))
+	c.remember("c", "1")
+
+	assert.True(t, c.seen("a", "1"), "Recently used story package should be kept")
+	assert.False(t, c.seen("b", "1"), "Least recently used story package should be evicted")
+	assert.True(t, c.seen("c", "1"))
+}
+
+func TestDedupCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+
+	c, clock := newTestDedupCache(t, 10, path)
+	c.remember("a", "1")
+	clock.now = clock.now.Add(-2 * time.Minute)
+	c.remember("expired", "1")
+	clock.now = clock.now.Add(2 * time.Minute)
+	c.remember("b", "2")
+	assert.NoError(t, c.save())
+
+	loaded, err := newDedupCache(10, time.Minute, path)
+	assert.NoError(t, err)
+	loaded.now = clock.Now
+	assert.Equal(t, 2, loaded.entries.len(), "Expired story packages should not be loaded")
+	assert.True(t, loaded.seen("a", "1"))
+	assert.True(t, loaded.seen("b", "2"))
+
+	assert.NoError(t, os.WriteFile(path, []byte("invalid"), 0o600))
+	_, err = newDedupCache(10, time.Minute, path)
+	assert.Error(t, err)
+}
+
+func TestDisabledDedupCache(t *testing.T) {
+	c, err := newDedupCache(0, time.Minute, "")
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	c.remember("a", "1")
+	assert.False(t, c.seen("a", "1"))
+	c.forget("a")
+	assert.NoError(t, c.save())
+}
+
+func TestStoryPackageHash(t *testing.T) {
+	items := []Item{{UUID: "c4cde316-128c-11e7-80f4-13e067d5072c", Position: 1}}
+	hash, err := storyPackageHash(&relatedContentMapper{relatedItems: items})
+	assert.NoError(t, err)
+
+	sameHash, _ := storyPackageHash(&relatedContentMapper{relatedItems: items, tid: "other"})
+	assert.Equal(t, hash, sameHash, "Hash should only depend on the items")
+
+	otherItems, _ := storyPackageHash(&relatedContentMapper{relatedItems: append(items, Item{UUID: "d4cde316-128c-11e7-80f4-13e067d5072c", Position: 2})})
+	assert.NotEqual(t, hash, otherItems)
+
+	emptyHash, _ := storyPackageHash(&relatedContentMapper{relatedItems: []Item{}})
+	deletedHash, _ := storyPackageHash(&relatedContentMapper{deleted: true})
+	assert.NotEqual(t, emptyHash, deletedHash, "Deleting the story package should not be taken for emptying it")
+}
+
+func TestQueueConsumeSuppressesDuplicates(t *testing.T) {
+	dedup, _ := newTestDedupCache(t, 10, "")
+	metrics := newPipelineMetrics(prometheus.NewRegistry())
+	mockMsgProducer := mockMessageProducer{}
+	h := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		dedup:           dedup,
+		metrics:         metrics,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	for _, fileName := range []string{"next-video-input.json", "next-video-input.json", "next-video-empty-related-input.json"} {
+		mockMsgProducer.sendCalled = false
+		h.queueConsume(kafka.FTMessage{
+			Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+			Body:    string(getBytes(fileName, t)),
+		})
+	}
+
+	assert.True(t, mockMsgProducer.sendCalled, "Changed story package should be sent")
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeProduced)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeDuplicate)))
+}
+
+func TestQueueConsumeAfterReplay(t *testing.T) {
+	dedup, _ := newTestDedupCache(t, 10, "")
+	metrics := newPipelineMetrics(prometheus.NewRegistry())
+	mockMsgProducer := mockMessageProducer{}
+	qh := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		dedup:           dedup,
+		metrics:         metrics,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+	sh := serviceHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		dedup:           dedup,
+		log:             qh.log,
+	}
+	consume := func() {
+		qh.queueConsume(kafka.FTMessage{
+			Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+			Body:    string(getBytes("next-video-input.json", t)),
+		})
+	}
+
+	consume()
+	req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/replay", getReader("next-video-empty-related-input.json", t))
+	req.Header.Set("X-Request-Id", "1234")
+	req.Header.Set("Message-Timestamp", lastModified)
+	w := httptest.NewRecorder()
+	sh.replayRequest(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	mockMsgProducer.sendCalled = false
+	consume()
+
+	assert.True(t, mockMsgProducer.sendCalled, "Story package changed by the replay should be sent again")
+	assert.Equal(t, newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", lastModified, false), mockMsgProducer.message)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeDuplicate)))
+
+	mockMsgProducer.sendCalled = false
+	consume()
+	assert.False(t, mockMsgProducer.sendCalled, "Unchanged story package should still be skipped")
+}
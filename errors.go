@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Financial-Times/go-logger/v2"
+)
+
+// Stable codes of the errors returned to the clients of the HTTP endpoints.
+const (
+	errCodeInvalidRequest = "invalid_request"
+	errCodeInvalidJSON    = "invalid_json"
+	errCodeMissingField   = "missing_field"
+	errCodeWrongFieldType = "wrong_field_type"
+	errCodeUUIDDerivation = "uuid_derivation_failed"
+	errCodeSchema         = "schema_violation"
+	errCodeTimestamp      = "invalid_timestamp"
+	errCodeStale          = "stale_message"
+	errCodeProduceFailed  = "produce_failed"
+)
+
+// mappingError is an error found while mapping a native video, with a machine-readable code
+// and the JSON pointer of the offending field when there is one.
+type mappingError struct {
+	code       string
+	field      string
+	message    string
+	violations []Violation
+}
+
+func (e *mappingError) Error() string {
+	return e.message
+}
+
+// status returns 400 for a body that is not JSON or invalid headers, 409 for a video older than the last one sent
+// for its story package, 422 for a JSON body that cannot be mapped and 503 for a message that cannot be sent.
+func (e *mappingError) status() int {
+	switch e.code {
+	case errCodeInvalidJSON, errCodeInvalidRequest, errCodeTimestamp:
+		return http.StatusBadRequest
+	case errCodeStale:
+		return http.StatusConflict
+	case errCodeProduceFailed:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+func invalidJSONError(err error, content string) error {
+	return &mappingError{
+		code:    errCodeInvalidJSON,
+		message: fmt.Sprintf("video JSON from Next couldn't be unmarshalled: %v. Skipping invalid JSON: %v", err.Error(), content),
+	}
+}
+
+func invalidTimestampError(err error) error {
+	return &mappingError{
+		code:    errCodeTimestamp,
+		message: fmt.Sprintf("Message-Timestamp couldn't be parsed: %v", err),
+	}
+}
+
+func staleMessageError(err error) error {
+	return &mappingError{
+		code:    errCodeStale,
+		message: err.Error(),
+	}
+}
+
+func produceFailedError(message string, err error) error {
+	return &mappingError{
+		code:    errCodeProduceFailed,
+		message: fmt.Sprintf("%s: %v", message, err),
+	}
+}
+
+func nullFieldError(fieldKey string) error {
+	return &mappingError{
+		code:    errCodeMissingField,
+		field:   fieldPointer(fieldKey),
+		message: fmt.Sprintf("[%s] field of native Next video JSON is missing or is null", fieldKey),
+	}
+}
+
+func wrongFieldTypeError(expectedType, fieldKey string, value interface{}) error {
+	return &mappingError{
+		code:    errCodeWrongFieldType,
+		field:   fieldPointer(fieldKey),
+		message: fmt.Sprintf("[%s] field of native Next video JSON is not of type %s: [%v]", fieldKey, expectedType, value),
+	}
+}
+
+func uuidDerivationError(fieldKey string) error {
+	return &mappingError{
+		code:    errCodeUUIDDerivation,
+		field:   fieldPointer(fieldKey),
+		message: "Error generating story package UUID",
+	}
+}
+
+func schemaViolationError(violations []Violation) error {
+	details := make([]string, 0, len(violations))
+	for _, v := range violations {
+		details = append(details, fmt.Sprintf("%s: %s", fieldOrRoot(v.Field), v.Message))
+	}
+	return &mappingError{
+		code:       errCodeSchema,
+		message:    fmt.Sprintf("native Next video JSON doesn't match the schema: %s", strings.Join(details, "; ")),
+		violations: violations,
+	}
+}
+
+func fieldOrRoot(field string) string {
+	if field == "" {
+		return "/"
+	}
+	return field
+}
+
+func fieldPointer(fieldKey string) string {
+	return "/" + fieldKey
+}
+
+// errorViolations returns the schema violations of a mapping error, if any.
+func errorViolations(err error) []Violation {
+	var me *mappingError
+	if errors.As(err, &me) {
+		return me.violations
+	}
+	return nil
+}
+
+// errorCode returns the code and field of a mapping error, or the generic invalid request code for other errors.
+func errorCode(err error) (string, string) {
+	var me *mappingError
+	if errors.As(err, &me) {
+		return me.code, me.field
+	}
+	return errCodeInvalidRequest, ""
+}
+
+// writeProblem responds with a JSON problem document (RFC 7807) describing err.
+func writeProblem(w http.ResponseWriter, err error, tid string, log *logger.UPPLogger) {
+	status := http.StatusBadRequest
+	var me *mappingError
+	if errors.As(err, &me) {
+		status = me.status()
+	}
+	code, field := errorCode(err)
+
+	body, err2 := json.Marshal(Problem{
+		Type:       "about:blank",
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     err.Error(),
+		Code:       code,
+		Field:      field,
+		Violations: errorViolations(err),
+	})
+	if err2 != nil {
+		log.WithError(err2).WithTransactionID(tid).Error("Marshalling problem document error.")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	if _, err2 = w.Write(body); err2 != nil {
+		log.WithError(err2).WithTransactionID(tid).Error("Writing response error.")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		expectedCode  string
+		expectedField string
+	}{
+		{"missing field", nullFieldError("id"), errCodeMissingField, "/id"},
+		{"wrong field type", wrongFieldTypeError("string", "uuid", 1), errCodeWrongFieldType, "/uuid"},
+		{"uuid derivation", uuidDerivationError("id"), errCodeUUIDDerivation, "/id"},
+		{"invalid JSON", invalidJSONError(errors.New("unexpected end of JSON input"), "{"), errCodeInvalidJSON, ""},
+		{"wrapped", newStageError(stageMap, nullFieldError("related")), errCodeMissingField, "/related"},
+		{"other error", errors.New("origin system x is not supported"), errCodeInvalidRequest, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, field := errorCode(test.err)
+			assert.Equal(t, test.expectedCode, code)
+			assert.Equal(t, test.expectedField, field)
+		})
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+	}{
+		{"invalid JSON", invalidJSONError(errors.New("unexpected end of JSON input"), "{"), http.StatusBadRequest},
+		{"missing field", nullFieldError("id"), http.StatusUnprocessableEntity},
+		{"uuid derivation", fmt.Errorf("mapping: %w", uuidDerivationError("id")), http.StatusUnprocessableEntity},
+		{"produce failed", produceFailedError("Error sending replayed message to queue", errors.New("broker unavailable")), http.StatusServiceUnavailable},
+		{"other error", errors.New("invalid dryRun value: maybe"), http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeProblem(w, test.err, "tid_test", logger.NewUPPLogger("video-mapper", "Debug"))
+
+			assert.Equal(t, test.expectedStatus, w.Code)
+			assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+
+			var problem Problem
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+			assert.Equal(t, "about:blank", problem.Type)
+			assert.Equal(t, http.StatusText(test.expectedStatus), problem.Title)
+			assert.Equal(t, test.expectedStatus, problem.Status)
+			assert.Equal(t, test.err.Error(), problem.Detail)
+		})
+	}
+}
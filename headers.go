@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const defaultLineageHeader = "X-Native-Message-Id"
+
+// headerPolicy decides which headers of a native message are carried over to the messages sent for it.
+// The headers set by the service itself always win over the propagated, renamed and static ones.
+type headerPolicy struct {
+	propagate []string
+	rename    map[string]string
+	static    map[string]string
+	lineage   string
+}
+
+// newHeaderPolicy builds a policy from the headers to copy as they are, the "From:To" headers to copy under another name,
+// the "Name:Value" headers to add to every message and the header carrying the native Message-Id, none when empty.
+func newHeaderPolicy(propagate, rename, static []string, lineage string) (headerPolicy, error) {
+	renamed, err := parseHeaderPairs(rename)
+	if err != nil {
+		return headerPolicy{}, fmt.Errorf("invalid header rename: %w", err)
+	}
+	added, err := parseHeaderPairs(static)
+	if err != nil {
+		return headerPolicy{}, fmt.Errorf("invalid static header: %w", err)
+	}
+	for _, name := range propagate {
+		if strings.TrimSpace(name) == "" {
+			return headerPolicy{}, fmt.Errorf("invalid propagated header: empty name")
+		}
+	}
+	return headerPolicy{
+		propagate: propagate,
+		rename:    renamed,
+		static:    added,
+		lineage:   strings.TrimSpace(lineage),
+	}, nil
+}
+
+// parseHeaderPairs reads "Name:Value" entries. The value is everything after the first colon.
+func parseHeaderPairs(entries []string) (map[string]string, error) {
+	result := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not a Name:Value pair", entry)
+		}
+		result[name] = strings.TrimSpace(value)
+	}
+	return result, nil
+}
+
+// apply adds the headers of the policy taken from the native message headers to the ones of a sent message.
+func (p headerPolicy) apply(origMsgHeaders, headers map[string]string) {
+	for name, value := range p.static {
+		headers[name] = value
+	}
+	for _, name := range p.propagate {
+		if value, ok := lookupHeader(origMsgHeaders, name); ok {
+			headers[name] = value
+		}
+	}
+	for from, to := range p.rename {
+		if value, ok := lookupHeader(origMsgHeaders, from); ok {
+			headers[to] = value
+		}
+	}
+	if p.lineage != "" && origMsgHeaders["Message-Id"] != "" {
+		headers[p.lineage] = origMsgHeaders["Message-Id"]
+	}
+}
+
+// lookupHeader returns the value of the header, matching its name case-insensitively as the producers of the
+// native messages do not agree on the case.
+func lookupHeader(headers map[string]string, name string) (string, bool) {
+	if value, ok := headers[name]; ok {
+		return value, true
+	}
+	for k, value := range headers {
+		if strings.EqualFold(k, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func createHeader(origMsgHeaders map[string]string, lastModified string, policy headerPolicy) map[string]string {
+	headers := make(map[string]string)
+	policy.apply(origMsgHeaders, headers)
+
+	headers["X-Request-Id"] = origMsgHeaders["X-Request-Id"]
+	headers["Message-Timestamp"] = lastModified
+	headers["Message-Id"] = uuid.New().String()
+	headers["Message-Type"] = generatedMsgType
+	headers["Content-Type"] = "application/json"
+	headers["Origin-System-Id"] = origMsgHeaders["Origin-System-Id"]
+	return headers
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHeaderPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		propagate     []string
+		rename        []string
+		static        []string
+		lineage       string
+		expected      headerPolicy
+		expectedError string
+	}{
+		{
+			name:     "empty",
+			expected: headerPolicy{rename: map[string]string{}, static: map[string]string{}},
+		},
+		{
+			name:      "all",
+			propagate: []string{"X-Trace"},
+			rename:    []string{"X-Source:X-Native-Source"},
+			static:    []string{"X-Pipeline: video : mapper"},
+			lineage:   defaultLineageHeader,
+			expected: headerPolicy{
+				propagate: []string{"X-Trace"},
+				rename:    map[string]string{"X-Source": "X-Native-Source"},
+				static:    map[string]string{"X-Pipeline": "video : mapper"},
+				lineage:   defaultLineageHeader,
+			},
+		},
+		{name: "empty propagated header", propagate: []string{" "}, expectedError: "invalid propagated header: empty name"},
+		{name: "rename without colon", rename: []string{"X-Source"}, expectedError: `invalid header rename: "X-Source" is not a Name:Value pair`},
+		{name: "static without name", static: []string{":value"}, expectedError: `invalid static header: ":value" is not a Name:Value pair`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := newHeaderPolicy(test.propagate, test.rename, test.static, test.lineage)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, policy)
+		})
+	}
+}
+
+func TestCreateHeader(t *testing.T) {
+	native := map[string]string{
+		"X-Request-Id":      "tid_1234",
+		"Origin-System-Id":  nextVideoOrigin,
+		"Message-Id":        "5e0b3da8-9b5b-4a5c-8a58-0b0d4d3a1f10",
+		"Message-Type":      "cms-content-published",
+		"Content-Type":      "application/vnd.ft-upp-video+json",
+		"Message-Timestamp": "2017-04-04T14:42:58.920Z",
+		"X-Trace":           "trace-1",
+		"X-Source":          "editor",
+	}
+
+	tests := []struct {
+		name            string
+		policy          headerPolicy
+		expectedExtra   map[string]string
+		expectedMissing []string
+	}{
+		{
+			name:            "no policy",
+			policy:          headerPolicy{},
+			expectedMissing: []string{"X-Trace", "X-Source", defaultLineageHeader},
+		},
+		{
+			name:            "propagate",
+			policy:          headerPolicy{propagate: []string{"X-Trace", "X-Missing"}},
+			expectedExtra:   map[string]string{"X-Trace": "trace-1"},
+			expectedMissing: []string{"X-Missing", "X-Source"},
+		},
+		{
+			name:            "rename",
+			policy:          headerPolicy{rename: map[string]string{"X-Source": "X-Native-Source"}},
+			expectedExtra:   map[string]string{"X-Native-Source": "editor"},
+			expectedMissing: []string{"X-Source"},
+		},
+		{
+			name:            "propagate in another case",
+			policy:          headerPolicy{propagate: []string{"x-trace"}},
+			expectedExtra:   map[string]string{"x-trace": "trace-1"},
+			expectedMissing: []string{"X-Trace"},
+		},
+		{
+			name:            "rename in another case",
+			policy:          headerPolicy{rename: map[string]string{"x-source": "X-Native-Source"}},
+			expectedExtra:   map[string]string{"X-Native-Source": "editor"},
+			expectedMissing: []string{"X-Source", "x-source"},
+		},
+		{
+			name:          "static",
+			policy:        headerPolicy{static: map[string]string{"X-Pipeline": "video"}},
+			expectedExtra: map[string]string{"X-Pipeline": "video"},
+		},
+		{
+			name:          "lineage",
+			policy:        headerPolicy{lineage: defaultLineageHeader},
+			expectedExtra: map[string]string{defaultLineageHeader: "5e0b3da8-9b5b-4a5c-8a58-0b0d4d3a1f10"},
+		},
+		{
+			name: "service headers win",
+			policy: headerPolicy{
+				propagate: []string{"Content-Type", "Message-Id"},
+				rename:    map[string]string{"X-Source": "Origin-System-Id"},
+				static:    map[string]string{"Message-Type": "other"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := createHeader(native, lastModified, test.policy)
+
+			assert.Equal(t, "tid_1234", headers["X-Request-Id"])
+			assert.Equal(t, nextVideoOrigin, headers["Origin-System-Id"])
+			assert.Equal(t, lastModified, headers["Message-Timestamp"])
+			assert.Equal(t, generatedMsgType, headers["Message-Type"])
+			assert.Equal(t, "application/json", headers["Content-Type"])
+			assert.NotEqual(t, native["Message-Id"], headers["Message-Id"], "Sent messages should get a new Message-Id")
+			for name, value := range test.expectedExtra {
+				assert.Equal(t, value, headers[name], "Header %s", name)
+			}
+			for _, name := range test.expectedMissing {
+				assert.NotContains(t, headers, name)
+			}
+			assert.Len(t, headers, 6+len(test.expectedExtra))
+		})
+	}
+}
+
+func TestCreateHeaderLineageWithoutMessageID(t *testing.T) {
+	headers := createHeader(map[string]string{"X-Request-Id": "tid_1234"}, lastModified, headerPolicy{lineage: defaultLineageHeader})
+	assert.NotContains(t, headers, defaultLineageHeader)
+}
+
+func TestQueueConsumeHeaderPolicy(t *testing.T) {
+	mockMsgProducer := recordingMessageProducer{}
+	h := queueHandler{
+		sc: serviceConfig{headers: headerPolicy{
+			propagate: []string{"X-Trace"},
+			static:    map[string]string{"X-Pipeline": "video"},
+			lineage:   defaultLineageHeader,
+		}},
+		messageProducer: &mockMsgProducer,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	headers := createHeaders(nextVideoOrigin, "application/json", "1234", lastModified)
+	headers["Message-Id"] = "5e0b3da8-9b5b-4a5c-8a58-0b0d4d3a1f10"
+	headers["X-Trace"] = "trace-1"
+	h.queueConsume(kafka.FTMessage{Headers: headers, Body: string(getBytes("next-video-input.json", t))})
+
+	if assert.Len(t, mockMsgProducer.messages, 1) {
+		sent := mockMsgProducer.messages[0].Headers
+		assert.Equal(t, "trace-1", sent["X-Trace"])
+		assert.Equal(t, "video", sent["X-Pipeline"])
+		assert.Equal(t, "5e0b3da8-9b5b-4a5c-8a58-0b0d4d3a1f10", sent[defaultLineageHeader])
+	}
+}
@@ -17,12 +17,22 @@ type messageConsumerHealthcheck interface {
 type messageProducerHealthcheck interface {
 	ConnectivityCheck() error
 }
+
+// optionalProducerCheck checks the producer of an optional topic, set only when that topic is configured.
+type optionalProducerCheck struct {
+	id             string
+	name           string
+	businessImpact string
+	producer       messageProducerHealthcheck
+}
+
 type HealthCheck struct {
-	consumer      messageConsumerHealthcheck
-	producer      messageProducerHealthcheck
-	appSystemCode string
-	appName       string
-	panicGuide    string
+	consumer          messageConsumerHealthcheck
+	producer          messageProducerHealthcheck
+	optionalProducers []optionalProducerCheck
+	appSystemCode     string
+	appName           string
+	panicGuide        string
 }
 
 func NewHealthCheck(p messageProducerHealthcheck, c messageConsumerHealthcheck, appName, appSystemCode, panicGuide string) *HealthCheck {
@@ -35,8 +45,17 @@ func NewHealthCheck(p messageProducerHealthcheck, c messageConsumerHealthcheck,
 	}
 }
 
+// AddProducer checks the connectivity of the producer of an optional topic along with the write topic,
+// on both the health and gtg endpoints.
+func (h *HealthCheck) AddProducer(id, name, businessImpact string, p messageProducerHealthcheck) {
+	h.optionalProducers = append(h.optionalProducers, optionalProducerCheck{id: id, name: name, businessImpact: businessImpact, producer: p})
+}
+
 func (h *HealthCheck) Health() func(w http.ResponseWriter, r *http.Request) {
 	checks := []fthealth.Check{h.readQueueCheck(), h.readQueueLagCheck(), h.writeQueueCheck()}
+	for _, p := range h.optionalProducers {
+		checks = append(checks, h.optionalQueueCheck(p))
+	}
 	hc := fthealth.TimedHealthCheck{
 		HealthCheck: fthealth.HealthCheck{
 			SystemCode:  h.appSystemCode,
@@ -73,6 +92,18 @@ func (h *HealthCheck) writeQueueCheck() fthealth.Check {
 	}
 }
 
+func (h *HealthCheck) optionalQueueCheck(p optionalProducerCheck) fthealth.Check {
+	return fthealth.Check{
+		ID:               p.id + "-message-queue-reachable",
+		Name:             p.name + " Message Queue Reachable",
+		Severity:         2,
+		BusinessImpact:   p.businessImpact,
+		TechnicalSummary: p.name + " message queue is not reachable/healthy",
+		PanicGuide:       h.panicGuide,
+		Checker:          producerConnectivityChecker(p.producer),
+	}
+}
+
 func (h *HealthCheck) readQueueLagCheck() fthealth.Check {
 	return fthealth.Check{
 		ID:               "read-message-queue-lagging",
@@ -93,10 +124,18 @@ func (h *HealthCheck) GTG() gtg.Status {
 		return gtgCheck(h.checkIfKafkaIsReachableFromProducer)
 	}
 
-	return gtg.FailFastParallelCheck([]gtg.StatusChecker{
+	checks := []gtg.StatusChecker{
 		consumerCheck,
 		producerCheck,
-	})()
+	}
+	for _, p := range h.optionalProducers {
+		checker := producerConnectivityChecker(p.producer)
+		checks = append(checks, func() gtg.Status {
+			return gtgCheck(checker)
+		})
+	}
+
+	return gtg.FailFastParallelCheck(checks)()
 }
 
 func gtgCheck(handler func() (string, error)) gtg.Status {
@@ -123,9 +162,15 @@ func (h *HealthCheck) checkIfConsumerIsLagging() (string, error) {
 }
 
 func (h *HealthCheck) checkIfKafkaIsReachableFromProducer() (string, error) {
-	err := h.producer.ConnectivityCheck()
-	if err != nil {
-		return "", err
+	return producerConnectivityChecker(h.producer)()
+}
+
+func producerConnectivityChecker(p messageProducerHealthcheck) func() (string, error) {
+	return func() (string, error) {
+		err := p.ConnectivityCheck()
+		if err != nil {
+			return "", err
+		}
+		return "OK", nil
 	}
-	return "OK", nil
 }
@@ -114,6 +114,25 @@ func TestGTGBrokenProducer(t *testing.T) {
 	assert.Equal(t, "error connecting to the queue", status.Message)
 }
 
+func TestHealthCheckWithOptionalProducers(t *testing.T) {
+	hc := initializeHealthCheck(true, true, true)
+	hc.AddProducer("dead-letter", "Dead-Letter", "Failures will be lost.", &mockProducerInstance{isConnectionHealthy: false})
+	hc.AddProducer("relationship", "Relationship", "Relationships will not be sent.", &mockProducerInstance{isConnectionHealthy: true})
+
+	req := httptest.NewRequest("GET", "http://example.com/__health", nil)
+	w := httptest.NewRecorder()
+
+	hc.Health()(w, req)
+
+	assert.Contains(t, w.Body.String(), `"name":"Write Message Queue Reachable","ok":true`, "Write message queue healthcheck should be happy")
+	assert.Contains(t, w.Body.String(), `"name":"Dead-Letter Message Queue Reachable","ok":false`, "Dead-letter message queue healthcheck should be unhappy")
+	assert.Contains(t, w.Body.String(), `"name":"Relationship Message Queue Reachable","ok":true`, "Relationship message queue healthcheck should be happy")
+
+	status := hc.GTG()
+	assert.False(t, status.GoodToGo, "An unreachable optional topic should not be good to go")
+	assert.Equal(t, "error connecting to the queue", status.Message)
+}
+
 type mockProducerInstance struct {
 	isConnectionHealthy bool
 }
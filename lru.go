@@ -0,0 +1,67 @@
+package main
+
+import "container/list"
+
+// lru maps keys to values, holding up to size entries and evicting the least recently used.
+// It is not safe for concurrent use.
+type lru[V any] struct {
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newLRU[V any](size int) *lru[V] {
+	return &lru[V]{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the value of key, marking it as the most recently used.
+func (c *lru[V]) get(key string) (V, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry[V]).value, true
+}
+
+// put sets the value of key, marking it as the most recently used.
+func (c *lru[V]) put(key string, value V) {
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*lruEntry[V]).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back().Value.(*lruEntry[V]).key)
+	}
+}
+
+func (c *lru[V]) remove(key string) {
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lru[V]) len() int {
+	return c.order.Len()
+}
+
+// each calls fn with the entries, least recently used first.
+func (c *lru[V]) each(fn func(key string, value V)) {
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*lruEntry[V])
+		fn(e.key, e.value)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+	c := newLRU[int](2)
+
+	c.put("a", 1)
+	c.put("b", 2)
+	value, ok := c.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, value)
+
+	c.put("c", 3)
+	_, ok = c.get("b")
+	assert.False(t, ok, "Least recently used entry should be evicted")
+
+	c.put("a", 4)
+	var keys []string
+	var values []int
+	c.each(func(key string, value int) {
+		keys = append(keys, key)
+		values = append(values, value)
+	})
+	assert.Equal(t, []string{"c", "a"}, keys, "Entries should be listed least recently used first")
+	assert.Equal(t, []int{3, 4}, values)
+
+	c.remove("a")
+	assert.Equal(t, 1, c.len())
+	_, ok = c.get("a")
+	assert.False(t, ok)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,14 +14,22 @@ import (
 	status "github.com/Financial-Times/service-status-go/httphandlers"
 	"github.com/gorilla/handlers"
 	"github.com/jawher/mow.cli"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const serviceDescription = "Get the related content references from the Next video content, creates a story package holding those references and puts a message with them on kafka queue for further processing and ingestion on Neo4j."
 
 type serviceConfig struct {
-	appName     string
-	serviceName string
-	port        string
+	appName               string
+	serviceName           string
+	port                  string
+	relatedItemAttributes []string
+	emptyRelatedBehaviour string
+	legacyDeletePayload   bool
+	metadataPrecedence    string
+	messageKey            string
+	headers               headerPolicy
 }
 
 func main() {
@@ -79,6 +89,192 @@ func main() {
 		Desc:   "The topic to write the messages to.",
 		EnvVar: "Q_WRITE_TOPIC",
 	})
+	deadLetterTopic := app.String(cli.StringOpt{
+		Name:   "dead-letter-topic",
+		Value:  "",
+		Desc:   "The topic to write the messages that could not be mapped to. Leave empty to disable dead-lettering.",
+		EnvVar: "Q_DEAD_LETTER_TOPIC",
+	})
+	staleTopic := app.String(cli.StringOpt{
+		Name:   "stale-topic",
+		Value:  "",
+		Desc:   "The topic to write the messages older than the last one sent for their story package to. Leave empty to drop them.",
+		EnvVar: "Q_STALE_TOPIC",
+	})
+	relationshipTopic := app.String(cli.StringOpt{
+		Name:   "relationship-topic",
+		Value:  "",
+		Desc:   "The topic to write the video to story package relationship events to. Leave empty to disable them.",
+		EnvVar: "Q_RELATIONSHIP_TOPIC",
+	})
+	originProfilesConfig := app.String(cli.StringOpt{
+		Name:   "origin-profiles",
+		Value:  "",
+		Desc:   "JSON array of the accepted origin systems, each with the fields holding the video ID and the related items. Only the Next video editor is accepted when empty.",
+		EnvVar: "ORIGIN_PROFILES",
+	})
+	nativeVideoSchema := app.String(cli.StringOpt{
+		Name:   "native-video-schema",
+		Value:  "",
+		Desc:   "Path of the JSON schema the Next video payloads are validated against. The embedded schema is used when empty.",
+		EnvVar: "NATIVE_VIDEO_SCHEMA",
+	})
+	contentTypeIncludes := app.Strings(cli.StringsOpt{
+		Name:   "content-type-includes",
+		Value:  []string{},
+		Desc:   "Content types of the messages to map, wildcards and parameters allowed (e.g. application/*). All the content types not excluded are mapped when empty.",
+		EnvVar: "CONTENT_TYPE_INCLUDES",
+	})
+	contentTypeExcludes := app.Strings(cli.StringsOpt{
+		Name:   "content-type-excludes",
+		Value:  defaultContentTypeExcludes,
+		Desc:   "Content types of the messages to ignore, wildcards and parameters allowed (e.g. audio/*)",
+		EnvVar: "CONTENT_TYPE_EXCLUDES",
+	})
+	relatedItemAttributes := app.Strings(cli.StringsOpt{
+		Name:   "related-item-attributes",
+		Value:  []string{},
+		Desc:   "Attributes of the related items to carry through to the story package items (e.g. title)",
+		EnvVar: "RELATED_ITEM_ATTRIBUTES",
+	})
+	emptyRelatedBehaviour := app.String(cli.StringOpt{
+		Name:   "empty-related-behaviour",
+		Value:  emptyRelatedCollection,
+		Desc:   "What to publish when a video has no related items: an empty story package (empty-collection) or a delete event for it (delete)",
+		EnvVar: "EMPTY_RELATED_BEHAVIOUR",
+	})
+	legacyDeletePayload := app.Bool(cli.BoolOpt{
+		Name:   "legacy-delete-payload",
+		Value:  false,
+		Desc:   "Publish delete events with the video UUID as payload UUID, for the consumers still relying on the old shape",
+		EnvVar: "LEGACY_DELETE_PAYLOAD",
+	})
+	metadataPrecedence := app.String(cli.StringOpt{
+		Name:   "metadata-precedence",
+		Value:  precedenceHeader,
+		Desc:   "Where the publish reference and last modified date are taken from when both the message headers and the video have them: header, body or latest (the most recently modified)",
+		EnvVar: "METADATA_PRECEDENCE",
+	})
+	messageKey := app.String(cli.StringOpt{
+		Name:   "message-key",
+		Value:  messageKeyCollection,
+		Desc:   "Kafka message key of the sent story packages: collection (the story package UUID), video (the video UUID) or none",
+		EnvVar: "MESSAGE_KEY",
+	})
+	propagateHeaders := app.Strings(cli.StringsOpt{
+		Name:   "propagate-headers",
+		Value:  []string{},
+		Desc:   "Headers of the native messages copied as they are to the sent messages",
+		EnvVar: "PROPAGATE_HEADERS",
+	})
+	renameHeaders := app.Strings(cli.StringsOpt{
+		Name:   "rename-headers",
+		Value:  []string{},
+		Desc:   "Headers of the native messages copied to the sent messages under another name, as From:To pairs",
+		EnvVar: "RENAME_HEADERS",
+	})
+	staticHeaders := app.Strings(cli.StringsOpt{
+		Name:   "static-headers",
+		Value:  []string{},
+		Desc:   "Headers added to every sent message, as Name:Value pairs",
+		EnvVar: "STATIC_HEADERS",
+	})
+	lineageHeader := app.String(cli.StringOpt{
+		Name:   "lineage-header",
+		Value:  defaultLineageHeader,
+		Desc:   "Header of the sent messages carrying the Message-Id of the native message, none when empty",
+		EnvVar: "LINEAGE_HEADER",
+	})
+	producerMaxAttempts := app.Int(cli.IntOpt{
+		Name:   "producer-max-attempts",
+		Value:  3,
+		Desc:   "Maximum number of attempts to send a message to the queue before giving up",
+		EnvVar: "PRODUCER_MAX_ATTEMPTS",
+	})
+	producerRetryBackoff := app.Int(cli.IntOpt{
+		Name:   "producer-retry-backoff",
+		Value:  200,
+		Desc:   "Initial backoff in milliseconds between attempts to send a message to the queue, doubled on each retry",
+		EnvVar: "PRODUCER_RETRY_BACKOFF",
+	})
+	producerMaxRetryBackoff := app.Int(cli.IntOpt{
+		Name:   "producer-max-retry-backoff",
+		Value:  5000,
+		Desc:   "Maximum backoff in milliseconds between attempts to send a message to the queue, 0 for no maximum",
+		EnvVar: "PRODUCER_MAX_RETRY_BACKOFF",
+	})
+	dedupCacheSize := app.Int(cli.IntOpt{
+		Name:   "dedup-cache-size",
+		Value:  10000,
+		Desc:   "Number of story packages remembered to skip sending them again when their items are unchanged. Set to 0 to disable.",
+		EnvVar: "DEDUP_CACHE_SIZE",
+	})
+	dedupCacheTTL := app.Int(cli.IntOpt{
+		Name:   "dedup-cache-ttl",
+		Value:  3600,
+		Desc:   "Seconds a sent story package is remembered for",
+		EnvVar: "DEDUP_CACHE_TTL",
+	})
+	dedupCacheFile := app.String(cli.StringOpt{
+		Name:   "dedup-cache-file",
+		Value:  "",
+		Desc:   "File the remembered story packages are loaded from on startup and saved to on shutdown. Kept in memory only when empty.",
+		EnvVar: "DEDUP_CACHE_FILE",
+	})
+	orderingCacheSize := app.Int(cli.IntOpt{
+		Name:   "ordering-cache-size",
+		Value:  100000,
+		Desc:   "Number of story packages whose last Message-Timestamp is remembered to drop older messages. Set to 0 to disable.",
+		EnvVar: "ORDERING_CACHE_SIZE",
+	})
+	orderingTolerance := app.Int(cli.IntOpt{
+		Name:   "ordering-tolerance",
+		Value:  0,
+		Desc:   "Milliseconds a message can be older than the last one sent for its story package and still be sent",
+		EnvVar: "ORDERING_TOLERANCE",
+	})
+	batchConcurrency := app.Int(cli.IntOpt{
+		Name:   "batch-concurrency",
+		Value:  defaultBatchConcurrency,
+		Desc:   "Maximum number of documents of a /map/batch request mapped concurrently",
+		EnvVar: "BATCH_CONCURRENCY",
+	})
+	workers := app.Int(cli.IntOpt{
+		Name:   "workers",
+		Value:  1,
+		Desc:   "Number of workers mapping and sending the consumed messages concurrently, the messages of a video being processed in order by the same worker",
+		EnvVar: "WORKERS",
+	})
+	workerQueueSize := app.Int(cli.IntOpt{
+		Name:   "worker-queue-size",
+		Value:  100,
+		Desc:   "Number of consumed messages waiting for each worker before the consumer blocks",
+		EnvVar: "WORKER_QUEUE_SIZE",
+	})
+	atLeastOnce := app.Bool(cli.BoolOpt{
+		Name:   "at-least-once",
+		Value:  false,
+		Desc:   "Let the consumer mark the offset of a message only once it is sent or parked, processing it again until then",
+		EnvVar: "AT_LEAST_ONCE",
+	})
+	traceExporter := app.String(cli.StringOpt{
+		Name:   "trace-exporter",
+		Value:  traceExporterNone,
+		Desc:   "Exporter of the OpenTelemetry trace spans: none, otlp or stdout (for local runs)",
+		EnvVar: "TRACE_EXPORTER",
+	})
+	otlpEndpoint := app.String(cli.StringOpt{
+		Name:   "otlp-endpoint",
+		Value:  "",
+		Desc:   "URL the spans are sent to over OTLP/HTTP, the one of the standard OTEL_EXPORTER_OTLP_* variables when empty",
+		EnvVar: "OTLP_ENDPOINT",
+	})
+	shutdownTimeout := app.Int(cli.IntOpt{
+		Name:   "shutdown-timeout",
+		Value:  30,
+		Desc:   "Seconds to wait on shutdown for the in-flight messages to be processed and the producers to be flushed",
+		EnvVar: "SHUTDOWN_TIMEOUT",
+	})
 	logLevel := app.String(cli.StringOpt{
 		Name:   "logLevel",
 		Value:  "INFO",
@@ -101,12 +297,63 @@ func main() {
 			log.Fatal("No queue address provided. Quitting...")
 		}
 
+		if *emptyRelatedBehaviour != emptyRelatedCollection && *emptyRelatedBehaviour != emptyRelatedDelete {
+			log.Fatalf("Invalid empty related behaviour %v. Quitting...", *emptyRelatedBehaviour)
+		}
+
+		switch *metadataPrecedence {
+		case precedenceHeader, precedenceBody, precedenceLatest:
+		default:
+			log.Fatalf("Invalid metadata precedence %v. Quitting...", *metadataPrecedence)
+		}
+
+		switch *messageKey {
+		case messageKeyCollection, messageKeyVideo, messageKeyNone:
+		default:
+			log.Fatalf("Invalid message key %v. Quitting...", *messageKey)
+		}
+
+		headers, err := newHeaderPolicy(*propagateHeaders, *renameHeaders, *staticHeaders, *lineageHeader)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid header propagation configuration. Quitting...")
+		}
+
+		tracing, err := newTracing(*traceExporter, *otlpEndpoint, *appSystemCode, os.Stdout)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid tracing configuration. Quitting...")
+		}
+
+		origins, err := parseOriginProfiles(*originProfilesConfig)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid origin profiles configuration. Quitting...")
+		}
+
+		validator, err := newPayloadValidator(origins, *nativeVideoSchema)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid payload schema. Quitting...")
+		}
+
+		dedup, err := newDedupCache(*dedupCacheSize, time.Duration(*dedupCacheTTL)*time.Second, *dedupCacheFile)
+		if err != nil {
+			log.WithError(err).Fatal("Idempotency cache could not be loaded. Quitting...")
+		}
+
+		filter, err := newContentTypeFilter(*contentTypeIncludes, *contentTypeExcludes)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid content type filter configuration. Quitting...")
+		}
+
 		sc := serviceConfig{
-			appName:     *appName,
-			serviceName: *serviceName,
-			port:        *port,
+			appName:               *appName,
+			serviceName:           *serviceName,
+			port:                  *port,
+			relatedItemAttributes: *relatedItemAttributes,
+			emptyRelatedBehaviour: *emptyRelatedBehaviour,
+			legacyDeletePayload:   *legacyDeletePayload,
+			metadataPrecedence:    *metadataPrecedence,
+			messageKey:            *messageKey,
+			headers:               headers,
 		}
-		sh := serviceHandler{sc, log}
 
 		consumerConfig := kafka.ConsumerConfig{
 			BrokersConnectionString: *kafkaAddress,
@@ -126,34 +373,98 @@ func main() {
 			ConnectionRetryInterval: time.Minute,
 		}
 
-		producer := kafka.NewProducer(producerConfig, log)
-		defer func(producer *kafka.Producer) {
-			err := producer.Close()
-			if err != nil {
-				log.WithError(err).Error("Producer could not stop")
-			}
-		}(producer)
+		producer := newKeyedProducer(producerConfig, log)
+		producers := map[string]io.Closer{"write": producer}
+		hc := NewHealthCheck(producer, consumer, *appName, *appSystemCode, *panicGuide)
 
-		qh := queueHandler{
+		policy := retryPolicy{
+			maxAttempts:    *producerMaxAttempts,
+			initialBackoff: time.Duration(*producerRetryBackoff) * time.Millisecond,
+			maxBackoff:     time.Duration(*producerMaxRetryBackoff) * time.Millisecond,
+		}
+
+		qh := &queueHandler{
 			sc:              sc,
-			messageProducer: producer,
+			messageProducer: newRetryingProducer(producer, policy, log),
+			origins:         origins,
+			filter:          filter,
+			validator:       validator,
+			dedup:           dedup,
+			ordering:        newOrderingGuard(*orderingCacheSize, time.Duration(*orderingTolerance)*time.Millisecond),
+			metrics:         newPipelineMetrics(prometheus.DefaultRegisterer),
+			tracing:         tracing,
+			atLeastOnce:     *atLeastOnce,
+			redelivery:      newRedeliveryPolicy(policy),
 			log:             log}
 
-		go consumer.Start(qh.queueConsume)
-		defer func(consumer *kafka.Consumer) {
-			err := consumer.Close()
-			if err != nil {
-				log.WithError(err).Error("Consumer could not stop")
-			}
-		}(consumer)
+		if *deadLetterTopic != "" {
+			deadLetterProducer := kafka.NewProducer(kafka.ProducerConfig{
+				BrokersConnectionString: *kafkaAddress,
+				Topic:                   *deadLetterTopic,
+				ConnectionRetryInterval: time.Minute,
+			}, log)
+			producers["dead-letter"] = deadLetterProducer
+			hc.AddProducer("dead-letter", "Dead-Letter", "Messages that cannot be mapped or sent will be lost instead of being parked for replay.", deadLetterProducer)
 
-		hc := NewHealthCheck(producer, consumer, *appName, *appSystemCode, *panicGuide)
+			qh.failureSink = &deadLetterSink{messageProducer: newRetryingProducer(deadLetterProducer, policy, log)}
+		}
+
+		if *staleTopic != "" {
+			staleProducer := kafka.NewProducer(kafka.ProducerConfig{
+				BrokersConnectionString: *kafkaAddress,
+				Topic:                   *staleTopic,
+				ConnectionRetryInterval: time.Minute,
+			}, log)
+			producers["stale"] = staleProducer
+			hc.AddProducer("stale", "Stale", "Messages older than the last one sent for their story package will be lost instead of being parked for inspection.", staleProducer)
+
+			qh.staleSink = &deadLetterSink{messageProducer: newRetryingProducer(staleProducer, policy, log)}
+		}
+
+		if *relationshipTopic != "" {
+			relationshipProducer := newKeyedProducer(kafka.ProducerConfig{
+				BrokersConnectionString: *kafkaAddress,
+				Topic:                   *relationshipTopic,
+				ConnectionRetryInterval: time.Minute,
+			}, log)
+			producers["relationship"] = relationshipProducer
+			hc.AddProducer("relationship", "Relationship", "Graph ingestion will not be told which story package belongs to published Next videos.", relationshipProducer)
+
+			qh.relationshipProducer = newRetryingProducer(relationshipProducer, policy, log)
+		}
+
+		sh := serviceHandler{
+			sc:                   sc,
+			messageProducer:      qh.messageProducer,
+			relationshipProducer: qh.relationshipProducer,
+			origins:              origins,
+			validator:            validator,
+			dedup:                dedup,
+			ordering:             qh.ordering,
+			tracing:              tracing,
+			batchConcurrency:     *batchConcurrency,
+			log:                  log,
+		}
+
+		qh.pool = newWorkerPool(*workers, *workerQueueSize, qh.messageKey, qh.queueConsume, qh.metrics)
+
+		go consumer.Start(qh.consume)
 
-		go func() {
-			serveAdminEndpoints(&sh, hc, log)
-		}()
+		server := serveAdminEndpoints(&sh, hc, log)
 
 		waitForSignal()
+
+		s := shutdownSequence{
+			consumer:  consumer,
+			handler:   qh,
+			cache:     dedup,
+			producers: producers,
+			tracing:   tracing,
+			server:    server,
+			timeout:   time.Duration(*shutdownTimeout) * time.Second,
+			log:       log,
+		}
+		s.run()
 	}
 	err := app.Run(os.Args)
 	if err != nil {
@@ -162,31 +473,47 @@ func main() {
 	}
 }
 
-func serveAdminEndpoints(sh *serviceHandler, hc *HealthCheck, log *logger.UPPLogger) {
+func serveAdminEndpoints(sh *serviceHandler, hc *HealthCheck, log *logger.UPPLogger) *http.Server {
 	serveMux := http.NewServeMux()
 
 	serveMux.Handle("/map", handlers.MethodHandler{"POST": http.HandlerFunc(sh.mapRequest)})
+	serveMux.Handle("/map/batch", handlers.MethodHandler{"POST": http.HandlerFunc(sh.mapBatchRequest)})
+	serveMux.Handle("/replay", handlers.MethodHandler{"POST": http.HandlerFunc(sh.replayRequest)})
+	serveMux.Handle("/metrics", promhttp.Handler())
 	serveMux.HandleFunc("/__health", hc.Health())
 	serveMux.HandleFunc(status.GTGPath, status.NewGoodToGoHandler(hc.GTG))
 	serveMux.HandleFunc(status.BuildInfoPath, status.BuildInfoHandler)
 
 	log.Info("Service started", sh.sc.asMap())
 
-	if err := http.ListenAndServe(":"+sh.sc.port, serveMux); err != nil {
-		log.Fatalf("Unable to start: %v", err)
-	}
+	server := &http.Server{Addr: ":" + sh.sc.port, Handler: serveMux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Unable to start: %v", err)
+		}
+	}()
+	return server
 }
 
 func waitForSignal() {
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
 }
 
 func (sc serviceConfig) asMap() map[string]interface{} {
 	return map[string]interface{}{
-		"app-name":     sc.appName,
-		"service-name": sc.serviceName,
-		"service-port": sc.port,
+		"app-name":                sc.appName,
+		"service-name":            sc.serviceName,
+		"service-port":            sc.port,
+		"related-item-attributes": sc.relatedItemAttributes,
+		"empty-related-behaviour": sc.emptyRelatedBehaviour,
+		"legacy-delete-payload":   sc.legacyDeletePayload,
+		"metadata-precedence":     sc.metadataPrecedence,
+		"message-key":             sc.messageKey,
+		"propagate-headers":       sc.headers.propagate,
+		"rename-headers":          sc.headers.rename,
+		"static-headers":          sc.headers.static,
+		"lineage-header":          sc.headers.lineage,
 	}
 }
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
+	"strings"
+	"time"
+
 	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/upp-next-video-content-collection-mapper/nativevideo"
 	uuidUtils "github.com/Financial-Times/uuid-utils-go"
 )
 
@@ -19,49 +21,71 @@ const (
 	uuidGenerationSalt = "storypackage"
 )
 
+// Precedence policies between the headers and the body for the publish reference and last modified date of a video.
+const (
+	precedenceHeader = "header"
+	precedenceBody   = "body"
+	precedenceLatest = "latest"
+)
+
+// Behaviours when no related items are left for the story package.
+const (
+	emptyRelatedCollection = "empty-collection"
+	emptyRelatedDelete     = "delete"
+)
+
+// Reasons for leaving a related item out of the story package.
+const (
+	rejectionMissingID     = "missing-id"
+	rejectionInvalidUUID   = "invalid-uuid"
+	rejectionDuplicate     = "duplicate"
+	rejectionSelfReference = "self-reference"
+)
+
 type relatedContentMapper struct {
-	sc           serviceConfig
-	strContent   string
-	tid          string
-	lastModified string
-	unmarshalled map[string]interface{}
-	log          *logger.UPPLogger
+	sc               serviceConfig
+	strContent       string
+	tid              string
+	lastModified     string
+	video            nativevideo.Video
+	profile          originProfile
+	storyPackageUUID string
+	relatedItems     []Item
+	rejectedItems    []ItemRejection
+	deleted          bool
+	log              *logger.UPPLogger
 }
 
 func (m *relatedContentMapper) mapRelatedContent() ([]byte, string, error) {
-	var uuidField string
-
-	if m.isDeleteEvent() {
-		uuidField = videoUUIDField
-	} else {
-		uuidField = videoIDField
-	}
+	profile := m.profile.withDefaults()
 
-	videoUUID, err := getRequiredStringField(uuidField, m.unmarshalled)
+	uuidField, err := m.readProfileFields(profile)
+	videoUUID := m.videoUUID()
 	if err != nil {
-		return nil, "", err
+		return nil, videoUUID, err
 	}
 
 	contentCollectionUUID, err := generateContentCollectionUUID(videoUUID)
 	if err != nil {
 		m.log.WithTransactionID(m.tid).WithUUID(videoUUID).Warn(err.Error())
-		return nil, "", errors.New("Error generating story package UUID")
+		return nil, "", uuidDerivationError(uuidField)
 	}
+	m.storyPackageUUID = contentCollectionUUID
 
 	var cc ContentCollection
-	if !m.isDeleteEvent() {
-		relatedItemsArray, err := getObjectsArrayField(relatedField, m.unmarshalled, videoUUID, m)
-		if err != nil {
-			return nil, videoUUID, err
-		}
-
-		relatedItems := m.retrieveRelatedItems(relatedItemsArray, videoUUID)
-		if len(relatedItems) > 0 {
-			cc = m.newContentCollection(contentCollectionUUID, relatedItems)
+	if !m.video.Deleted {
+		m.relatedItems = m.retrieveRelatedItems(m.video.Related, videoUUID)
+		switch {
+		case len(m.relatedItems) > 0:
+			cc = m.newContentCollection(contentCollectionUUID, m.relatedItems)
+		case m.sc.emptyRelatedBehaviour == emptyRelatedDelete:
+			m.log.WithTransactionID(m.tid).WithUUID(videoUUID).Info("No related items left, deleting the story package")
+			cc = m.newDeletedContentCollection(contentCollectionUUID, videoUUID)
+		default:
+			cc = m.newContentCollection(contentCollectionUUID, m.relatedItems)
 		}
 	} else {
-		cc.Deleted = true
-		cc.UUID = videoUUID
+		cc = m.newDeletedContentCollection(contentCollectionUUID, videoUUID)
 	}
 
 	mc := m.newMappedContent(contentCollectionUUID, cc)
@@ -75,15 +99,183 @@ func (m *relatedContentMapper) mapRelatedContent() ([]byte, string, error) {
 	return marshalledPubEvent, videoUUID, nil
 }
 
-func (m *relatedContentMapper) retrieveRelatedItems(relatedItemsArray []map[string]interface{}, videoUUID string) []Item {
-	var result = make([]Item, 0)
+// resolveMetadata chooses the publish reference and last modified date of the video between the ones of the headers,
+// already in tid and lastModified, and the ones of the body, following the precedence policy.
+// The values of the other source are used when the preferred ones are missing.
+func (m *relatedContentMapper) resolveMetadata() {
+	bodyTid := m.video.PublishReference
+	bodyLastModified, err := normaliseTimestamp(m.video.LastModified)
+	if err != nil {
+		m.log.WithTransactionID(m.tid).WithError(err).Warn("Ignoring the lastModified field of the video")
+		bodyLastModified = ""
+	}
+
+	preferBody := false
+	switch m.sc.metadataPrecedence {
+	case precedenceBody:
+		preferBody = true
+	case precedenceLatest:
+		preferBody = bodyLastModified != "" && (m.lastModified == "" || isAfter(bodyLastModified, m.lastModified))
+	}
+
+	if preferBody {
+		m.tid = firstNonEmpty(bodyTid, m.tid)
+		m.lastModified = firstNonEmpty(bodyLastModified, m.lastModified)
+	} else {
+		m.tid = firstNonEmpty(m.tid, bodyTid)
+		m.lastModified = firstNonEmpty(m.lastModified, bodyLastModified)
+	}
+}
+
+// isAfter compares two timestamps normalised to dateFormat.
+func isAfter(a, b string) bool {
+	ta, errA := time.Parse(dateFormat, a)
+	tb, errB := time.Parse(dateFormat, b)
+	return errA == nil && errB == nil && ta.After(tb)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// readProfileFields checks the fields of the video the mapping relies on and returns the name of the field
+// holding the video UUID. The fields of the Next video payloads are read from the typed model, while the fields
+// named by a custom origin profile are read from the document.
+func (m *relatedContentMapper) readProfileFields(profile originProfile) (string, error) {
+	if profile.hasDefaultFields() {
+		return m.checkDefaultFields()
+	}
+
+	document := m.video.Document()
+	if m.video.Deleted {
+		videoUUID, err := getRequiredStringField(profile.DeletedIDField, document)
+		m.video.UUID = videoUUID
+		return profile.DeletedIDField, err
+	}
+
+	videoUUID, err := getRequiredStringField(profile.IDField, document)
+	if err != nil {
+		return profile.IDField, err
+	}
+	m.video.ID = videoUUID
+
+	relatedItemsArray, err := getObjectsArrayField(profile.RelatedField, document, videoUUID, m)
+	if err != nil {
+		return profile.IDField, err
+	}
+	m.video.Related = make([]nativevideo.RelatedItem, 0, len(relatedItemsArray))
 	for _, relatedItem := range relatedItemsArray {
-		itemID, err := getRequiredStringField(relatedItemIDField, relatedItem)
-		if err != nil {
-			m.log.WithTransactionID(m.tid).WithUUID(videoUUID).WithError(err).Warn("Cannot extract related item id from related field")
+		m.video.Related = append(m.video.Related, nativevideo.NewRelatedItem(relatedItem, profile.RelatedItemIDField))
+	}
+	return profile.IDField, nil
+}
+
+// checkDefaultFields checks the typed fields of a Next video payload. As the decoding leaves the fields
+// of an unexpected type empty, the document is only looked at to tell why a field is empty.
+func (m *relatedContentMapper) checkDefaultFields() (string, error) {
+	document := m.video.Document()
+	if m.video.Deleted {
+		if m.video.UUID == "" {
+			_, err := getRequiredStringField(videoUUIDField, document)
+			return videoUUIDField, err
+		}
+		return videoUUIDField, nil
+	}
+
+	if m.video.ID == "" {
+		if _, err := getRequiredStringField(videoIDField, document); err != nil {
+			return videoIDField, err
+		}
+	}
+
+	related, ok := document[relatedField]
+	if !ok {
+		m.log.WithTransactionID(m.tid).WithUUID(m.video.ID).
+			WithField("event", "map").
+			Infof(nullFieldError(relatedField).Error())
+		return videoIDField, nil
+	}
+	if m.video.Related == nil {
+		if _, isArray := related.([]interface{}); !isArray {
+			return videoIDField, wrongFieldTypeError("object array", relatedField, related)
+		}
+	}
+	for _, item := range m.video.Related {
+		if item.Fields == nil {
+			return videoIDField, wrongFieldTypeError("object array", relatedField, related)
+		}
+	}
+	return videoIDField, nil
+}
+
+func (m *relatedContentMapper) videoUUID() string {
+	if m.video.Deleted {
+		return m.video.UUID
+	}
+	return m.video.ID
+}
+
+// retrieveRelatedItems builds the story package items from the related field, leaving out the items without a valid UUID,
+// the duplicates and the references to the video itself. The items left out are recorded in rejectedItems.
+func (m *relatedContentMapper) retrieveRelatedItems(relatedItemsArray []nativevideo.RelatedItem, videoUUID string) []Item {
+	var result = make([]Item, 0)
+	seen := make(map[string]bool)
+	itemIDField := m.profile.withDefaults().RelatedItemIDField
+	for i, relatedItem := range relatedItemsArray {
+		itemID := relatedItem.UUID
+		if itemID == "" {
+			_, err := getRequiredStringField(itemIDField, relatedItem.Fields)
+			m.rejectRelatedItem(i, "", rejectionMissingID, videoUUID, err)
+			continue
+		}
+		if _, err := uuidUtils.NewUUIDFromString(itemID); err != nil {
+			m.rejectRelatedItem(i, itemID, rejectionInvalidUUID, videoUUID, err)
+			continue
+		}
+		key := strings.ToLower(itemID)
+		if key == strings.ToLower(videoUUID) {
+			m.rejectRelatedItem(i, itemID, rejectionSelfReference, videoUUID, nil)
+			continue
+		}
+		if seen[key] {
+			m.rejectRelatedItem(i, itemID, rejectionDuplicate, videoUUID, nil)
 			continue
 		}
-		result = append(result, Item{UUID: itemID})
+		seen[key] = true
+
+		result = append(result, Item{
+			UUID:       itemID,
+			Position:   len(result) + 1,
+			Attributes: m.relatedItemAttributes(relatedItem.Fields),
+		})
+	}
+	return result
+}
+
+func (m *relatedContentMapper) rejectRelatedItem(index int, itemID, reason, videoUUID string, err error) {
+	m.rejectedItems = append(m.rejectedItems, ItemRejection{Index: index, UUID: itemID, Reason: reason})
+	m.log.WithTransactionID(m.tid).WithUUID(videoUUID).WithError(err).
+		WithField("index", index).WithField("itemUUID", itemID).WithField("reason", reason).
+		Warn("Related item left out of the story package")
+}
+
+// relatedItemAttributes copies the whitelisted attributes present on a related item.
+func (m *relatedContentMapper) relatedItemAttributes(relatedItem map[string]interface{}) map[string]interface{} {
+	var result map[string]interface{}
+	for _, attr := range m.sc.relatedItemAttributes {
+		value, ok := relatedItem[attr]
+		if !ok || value == nil {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]interface{})
+		}
+		result[attr] = value
 	}
 	return result
 }
@@ -97,6 +289,25 @@ func (m *relatedContentMapper) newMappedContent(ccUUID string, cc ContentCollect
 	}
 }
 
+// newDeletedContentCollection builds the payload deleting the story package of a video.
+// The legacy payload carries only the video UUID, for the consumers that still rely on it.
+func (m *relatedContentMapper) newDeletedContentCollection(ccUUID string, videoUUID string) ContentCollection {
+	m.deleted = true
+	if m.sc.legacyDeletePayload {
+		return ContentCollection{
+			UUID:    videoUUID,
+			Deleted: true,
+		}
+	}
+	return ContentCollection{
+		UUID:             ccUUID,
+		VideoUUID:        videoUUID,
+		PublishReference: m.tid,
+		LastModified:     m.lastModified,
+		Deleted:          true,
+	}
+}
+
 func (m *relatedContentMapper) newContentCollection(ccUUID string, items []Item) ContentCollection {
 	return ContentCollection{
 		UUID:             ccUUID,
@@ -148,21 +359,6 @@ func getObjectsArrayField(key string, obj map[string]interface{}, videoUUID stri
 	return result, nil
 }
 
-func nullFieldError(fieldKey string) error {
-	return fmt.Errorf("[%s] field of native Next video JSON is missing or is null", fieldKey)
-}
-
-func wrongFieldTypeError(expectedType, fieldKey string, value interface{}) error {
-	return fmt.Errorf("[%s] field of native Next video JSON is not of type %s: [%v]", fieldKey, expectedType, value)
-}
-
-func (m *relatedContentMapper) isDeleteEvent() bool {
-	if _, present := m.unmarshalled[deletedField]; present {
-		return true
-	}
-	return false
-}
-
 func generateContentCollectionUUID(videoUUID string) (string, error) {
 	uuid, err := uuidUtils.NewUUIDFromString(videoUUID)
 	if err != nil {
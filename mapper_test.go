@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/upp-next-video-content-collection-mapper/nativevideo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,21 +36,21 @@ func TestBuildRelatedItems(t *testing.T) {
 	log := logger.NewUPPLogger("video-mapper", "Debug")
 	m := relatedContentMapper{log: log}
 	tests := []struct {
-		nextRelatedItem []map[string]interface{}
+		nextRelatedItem []nativevideo.RelatedItem
 		expectedItems   []Item
 	}{
 		{
-			[]map[string]interface{}{
+			[]nativevideo.RelatedItem{
 				newRelatedItem("c4cde316-128c-11e7-80f4-13e067d5072c"),
 				newRelatedItem("e2290d14-7e80-4db8-a715-949da4de9a07"),
 			},
 			[]Item{
-				{UUID: "c4cde316-128c-11e7-80f4-13e067d5072c"},
-				{UUID: "e2290d14-7e80-4db8-a715-949da4de9a07"},
+				{UUID: "c4cde316-128c-11e7-80f4-13e067d5072c", Position: 1},
+				{UUID: "e2290d14-7e80-4db8-a715-949da4de9a07", Position: 2},
 			},
 		},
 		{
-			[]map[string]interface{}{
+			[]nativevideo.RelatedItem{
 				newRelatedItem(nil),
 			},
 			[]Item{},
@@ -61,6 +62,69 @@ func TestBuildRelatedItems(t *testing.T) {
 	}
 }
 
+func TestRetrieveRelatedItemsRejections(t *testing.T) {
+	log := logger.NewUPPLogger("video-mapper", "Debug")
+	m := relatedContentMapper{log: log}
+	relatedItemsArray := []nativevideo.RelatedItem{
+		newRelatedItem("c4cde316-128c-11e7-80f4-13e067d5072c"),
+		newRelatedItem("not-a-uuid"),
+		newRelatedItem(testVideoUUID),
+		newRelatedItem("C4CDE316-128C-11E7-80F4-13E067D5072C"),
+		newRelatedItem(nil),
+		newRelatedItem("d4cde316-128c-11e7-80f4-13e067d5072c"),
+	}
+
+	items := m.retrieveRelatedItems(relatedItemsArray, testVideoUUID)
+
+	assert.Equal(t, []Item{
+		{UUID: "c4cde316-128c-11e7-80f4-13e067d5072c", Position: 1},
+		{UUID: "d4cde316-128c-11e7-80f4-13e067d5072c", Position: 2},
+	}, items)
+	assert.Equal(t, []ItemRejection{
+		{Index: 1, UUID: "not-a-uuid", Reason: rejectionInvalidUUID},
+		{Index: 2, UUID: testVideoUUID, Reason: rejectionSelfReference},
+		{Index: 3, UUID: "C4CDE316-128C-11E7-80F4-13E067D5072C", Reason: rejectionDuplicate},
+		{Index: 4, Reason: rejectionMissingID},
+	}, m.rejectedItems)
+}
+
+func TestRetrieveRelatedItemsAttributes(t *testing.T) {
+	log := logger.NewUPPLogger("video-mapper", "Debug")
+	nextVideo, err := readContent("next-video-input.json")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	relatedItemsArray := nextVideo.Related
+
+	tests := []struct {
+		attributes    []string
+		expectedItems []Item
+	}{
+		{
+			nil,
+			[]Item{{UUID: "c4cde316-128c-11e7-80f4-13e067d5072c", Position: 1}},
+		},
+		{
+			[]string{"title", "missing"},
+			[]Item{{
+				UUID:       "c4cde316-128c-11e7-80f4-13e067d5072c",
+				Position:   1,
+				Attributes: map[string]interface{}{"title": "Stocks and dollar slide as ‘Trump trade’ fades"},
+			}},
+		},
+		{
+			[]string{"missing"},
+			[]Item{{UUID: "c4cde316-128c-11e7-80f4-13e067d5072c", Position: 1}},
+		},
+	}
+
+	for _, test := range tests {
+		m := relatedContentMapper{sc: serviceConfig{relatedItemAttributes: test.attributes}, log: log}
+		items := m.retrieveRelatedItems(relatedItemsArray, testVideoUUID)
+		assert.Equal(t, test.expectedItems, items, "Related items are wrong. Attributes: %v", test.attributes)
+	}
+}
+
 func TestMapNextVideoRelatedContentHappyFlows(t *testing.T) {
 	tests := []struct {
 		fileName          string
@@ -88,8 +152,8 @@ func TestMapNextVideoRelatedContentHappyFlows(t *testing.T) {
 			assert.Fail(t, err.Error())
 		}
 		m := relatedContentMapper{
-			sc:           serviceConfig{},
-			unmarshalled: nextVideo,
+			sc:    serviceConfig{},
+			video: nextVideo,
 		}
 
 		marshalledContent, videoUUID, err := m.mapRelatedContent()
@@ -100,6 +164,124 @@ func TestMapNextVideoRelatedContentHappyFlows(t *testing.T) {
 	}
 }
 
+func TestMapNextVideoDeleteContent(t *testing.T) {
+	nextVideo, err := readContent("next-video-delete-input.json")
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	legacyPayload, err := json.Marshal(MappedContent{
+		Payload:      ContentCollection{UUID: testVideoUUID, Deleted: true},
+		ContentURI:   contentURIPrefix + testContentCollectionUUID,
+		LastModified: "2017-04-04T14:42:58.920Z",
+		UUID:         testContentCollectionUUID,
+	})
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+
+	tests := []struct {
+		legacy          bool
+		expectedContent string
+	}{
+		{false, newStringMappedContent(t, "", "1234", "2017-04-04T14:42:58.920Z", true)},
+		{true, string(legacyPayload)},
+	}
+
+	for _, test := range tests {
+		m := relatedContentMapper{
+			sc:           serviceConfig{legacyDeletePayload: test.legacy},
+			tid:          "1234",
+			lastModified: "2017-04-04T14:42:58.920Z",
+			video:        nextVideo,
+		}
+
+		marshalledContent, videoUUID, err := m.mapRelatedContent()
+
+		assert.NoError(t, err)
+		assert.Equal(t, testVideoUUID, videoUUID)
+		assert.Equal(t, test.expectedContent, string(marshalledContent), "Marshalled content wrong. Legacy payload: %v", test.legacy)
+	}
+}
+
+func TestMapNextVideoEmptyRelatedContent(t *testing.T) {
+	log := logger.NewUPPLogger("video-mapper", "Debug")
+	tests := []struct {
+		fileName          string
+		behaviour         string
+		expectedContent   string
+		expectedIsDeleted bool
+	}{
+		{
+			"next-video-empty-related-input.json",
+			"",
+			newStringEmptyCollectionContent(t, "1234", "2017-04-04T14:42:58.920Z"),
+			false,
+		},
+		{
+			"next-video-empty-related-input.json",
+			emptyRelatedCollection,
+			newStringEmptyCollectionContent(t, "1234", "2017-04-04T14:42:58.920Z"),
+			false,
+		},
+		{
+			"next-video-empty-related-input.json",
+			emptyRelatedDelete,
+			newStringMappedContent(t, "", "1234", "2017-04-04T14:42:58.920Z", true),
+			true,
+		},
+		{
+			"next-video-related-no-item-id-input.json",
+			emptyRelatedDelete,
+			newStringMappedContent(t, "", "1234", "2017-04-04T14:42:58.920Z", true),
+			true,
+		},
+		{
+			"next-video-no-related-input.json",
+			emptyRelatedCollection,
+			newStringEmptyCollectionContent(t, "1234", "2017-04-04T14:42:58.920Z"),
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		nextVideo, err := readContent(test.fileName)
+		if err != nil {
+			assert.Fail(t, err.Error())
+		}
+		m := relatedContentMapper{
+			sc:           serviceConfig{emptyRelatedBehaviour: test.behaviour},
+			tid:          "1234",
+			lastModified: "2017-04-04T14:42:58.920Z",
+			video:        nextVideo,
+			log:          log,
+		}
+
+		marshalledContent, _, err := m.mapRelatedContent()
+
+		assert.NoError(t, err, "Input JSON: %s", test.fileName)
+		assert.Equal(t, test.expectedContent, string(marshalledContent), "Marshalled content wrong. Input JSON: %s, behaviour: %s", test.fileName, test.behaviour)
+		assert.Equal(t, test.expectedIsDeleted, m.deleted, "Deleted status wrong. Input JSON: %s, behaviour: %s", test.fileName, test.behaviour)
+	}
+}
+
+func TestMapNextVideoRelatedContentFromTypedVideo(t *testing.T) {
+	m := relatedContentMapper{
+		tid:          "1234",
+		lastModified: "2017-04-04T14:42:58.920Z",
+		video: nativevideo.Video{
+			ID:      testVideoUUID,
+			Related: []nativevideo.RelatedItem{newRelatedItem("c4cde316-128c-11e7-80f4-13e067d5072c")},
+		},
+		log: logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	marshalledContent, videoUUID, err := m.mapRelatedContent()
+
+	assert.NoError(t, err)
+	assert.Equal(t, testVideoUUID, videoUUID)
+	assert.Equal(t, newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", "2017-04-04T14:42:58.920Z", false), string(marshalledContent))
+}
+
 func TestMapNextVideoRelatedContentMissingFields(t *testing.T) {
 	log := logger.NewUPPLogger("video-mapper", "Debug")
 	tests := []struct {
@@ -133,12 +315,53 @@ func TestMapNextVideoRelatedContentMissingFields(t *testing.T) {
 		if err != nil {
 			assert.Fail(t, err.Error())
 		}
-		m := relatedContentMapper{unmarshalled: nextVideo, log: log}
+		m := relatedContentMapper{video: nextVideo, log: log}
 		_, _, err = m.mapRelatedContent()
 		assert.Equal(t, test.expectedErrStatus, err != nil, "Error status wrong. Input JSON: %s", test.fileName)
 	}
 }
 
+func TestResolveMetadata(t *testing.T) {
+	log := logger.NewUPPLogger("video-mapper", "Debug")
+	older := "2017-04-04T14:40:00.000Z"
+	newer := "2017-04-04T14:42:58.920Z"
+	tests := []struct {
+		name                 string
+		precedence           string
+		headerTid            string
+		headerLastModified   string
+		body                 nativevideo.Video
+		expectedTid          string
+		expectedLastModified string
+	}{
+		{"header first", precedenceHeader, "tid_header", older, nativevideo.Video{PublishReference: "tid_body", LastModified: newer}, "tid_header", older},
+		{"default", "", "tid_header", older, nativevideo.Video{PublishReference: "tid_body", LastModified: newer}, "tid_header", older},
+		{"header first without headers", precedenceHeader, "", "", nativevideo.Video{PublishReference: "tid_body", LastModified: newer}, "tid_body", newer},
+		{"body first", precedenceBody, "tid_header", newer, nativevideo.Video{PublishReference: "tid_body", LastModified: older}, "tid_body", older},
+		{"body first without body fields", precedenceBody, "tid_header", newer, nativevideo.Video{}, "tid_header", newer},
+		{"latest from body", precedenceLatest, "tid_header", older, nativevideo.Video{PublishReference: "tid_body", LastModified: newer}, "tid_body", newer},
+		{"latest from header", precedenceLatest, "tid_header", newer, nativevideo.Video{PublishReference: "tid_body", LastModified: older}, "tid_header", newer},
+		{"latest without header date", precedenceLatest, "tid_header", "", nativevideo.Video{PublishReference: "tid_body", LastModified: older}, "tid_body", older},
+		{"body date normalised", precedenceBody, "", "", nativevideo.Video{LastModified: "1491316978920"}, "", newer},
+		{"invalid body date", precedenceBody, "tid_header", older, nativevideo.Video{PublishReference: "tid_body", LastModified: "yesterday"}, "tid_body", older},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := relatedContentMapper{
+				sc:           serviceConfig{metadataPrecedence: test.precedence},
+				tid:          test.headerTid,
+				lastModified: test.headerLastModified,
+				video:        test.body,
+				log:          log,
+			}
+			m.resolveMetadata()
+			assert.Equal(t, test.expectedTid, m.tid)
+			assert.Equal(t, test.expectedLastModified, m.lastModified)
+		})
+	}
+}
+
 func TestGetRequiredStringField(t *testing.T) {
 	tests := []struct {
 		key           string
@@ -216,32 +439,51 @@ func TestGetObjectsArrayField(t *testing.T) {
 	}
 }
 
-func readContent(fileName string) (map[string]interface{}, error) {
+func readContent(fileName string) (nativevideo.Video, error) {
+	var result nativevideo.Video
 	data, err := ioutil.ReadFile("test-resources/" + fileName)
 	if err != nil {
-		return nil, err
+		return result, err
 	}
 
-	var result = make(map[string]interface{})
 	err = json.Unmarshal(data, &result)
-	if err != nil {
-		return nil, err
-	}
-	return result, nil
+	return result, err
 }
 
-func newRelatedItem(id interface{}) map[string]interface{} {
+func newRelatedItem(id interface{}) nativevideo.RelatedItem {
 	var obj = make(map[string]interface{})
 	if id != nil {
 		obj[relatedItemIDField] = id
 	}
-	return obj
+	return nativevideo.NewRelatedItem(obj, relatedItemIDField)
+}
+
+func newStringEmptyCollectionContent(t *testing.T, tid string, msgDate string) string {
+	mc := MappedContent{
+		Payload: ContentCollection{
+			UUID:             testContentCollectionUUID,
+			Items:            []Item{},
+			PublishReference: tid,
+			LastModified:     msgDate,
+			CollectionType:   collectionType,
+		},
+		ContentURI:   contentURIPrefix + testContentCollectionUUID,
+		LastModified: msgDate,
+		UUID:         testContentCollectionUUID,
+	}
+
+	marshalledContent, err := json.Marshal(mc)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	assert.Contains(t, string(marshalledContent), `"items":[]`)
+	return string(marshalledContent)
 }
 
 func newStringMappedContent(t *testing.T, itemUUID string, tid string, msgDate string, deletePayload bool) string {
 	var cc ContentCollection
 	if itemUUID != "" {
-		items := []Item{{itemUUID}}
+		items := []Item{{UUID: itemUUID, Position: 1}}
 		cc = ContentCollection{
 			UUID:             testContentCollectionUUID,
 			Items:            items,
@@ -251,8 +493,13 @@ func newStringMappedContent(t *testing.T, itemUUID string, tid string, msgDate s
 		}
 	}
 	if deletePayload {
-		cc.Deleted = true
-		cc.UUID = testVideoUUID
+		cc = ContentCollection{
+			UUID:             testContentCollectionUUID,
+			VideoUUID:        testVideoUUID,
+			PublishReference: tid,
+			LastModified:     msgDate,
+			Deleted:          true,
+		}
 	}
 
 	mc := MappedContent{
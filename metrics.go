@@ -0,0 +1,142 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "next_video_content_collection_mapper"
+
+// Outcomes of consuming a native message.
+const (
+	outcomeIgnoredOrigin      = "ignored_origin"
+	outcomeIgnoredContentType = "ignored_content_type"
+	outcomeMappingFailed      = "mapping_failed"
+	outcomeSkipped            = "skipped"
+	outcomeDuplicate          = "duplicate"
+	outcomeStale              = "stale"
+	outcomeProduced           = "produced"
+	outcomeDeleted            = "deleted"
+	outcomeProduceFailed      = "produce_failed"
+)
+
+// pipelineMetrics instruments the consume → map → produce pipeline.
+// A nil *pipelineMetrics is valid and records nothing.
+type pipelineMetrics struct {
+	messages        *prometheus.CounterVec
+	filtered        *prometheus.CounterVec
+	violations      *prometheus.CounterVec
+	mappingDuration prometheus.Histogram
+	sendDuration    prometheus.Histogram
+	relatedItems    prometheus.Gauge
+	queueDepth      *prometheus.GaugeVec
+	redeliveries    prometheus.Counter
+}
+
+func newPipelineMetrics(reg prometheus.Registerer) *pipelineMetrics {
+	m := &pipelineMetrics{
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_total",
+			Help:      "Number of consumed native messages by processing outcome.",
+		}, []string{"outcome"}),
+		filtered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "content_type_filtered_total",
+			Help:      "Number of consumed native messages dropped by the content type filter, by rule.",
+		}, []string{"rule"}),
+		violations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "schema_violations_total",
+			Help:      "Number of schema violations found in the consumed native messages, by JSON schema keyword.",
+		}, []string{"keyword"}),
+		mappingDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "mapping_duration_seconds",
+			Help:      "Time taken to map a native video to a story package.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+		}),
+		sendDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "send_duration_seconds",
+			Help:      "Time taken to send a mapped story package to the queue, including retries.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		relatedItems: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "related_items",
+			Help:      "Number of related items in the last mapped story package.",
+		}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "worker_queue_depth",
+			Help:      "Number of consumed native messages waiting for a worker, by worker.",
+		}, []string{"worker"}),
+		redeliveries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "redeliveries_total",
+			Help:      "Number of times a consumed native message was processed again in at-least-once mode, as it was neither sent nor parked.",
+		}),
+	}
+	reg.MustRegister(m.messages, m.filtered, m.violations, m.mappingDuration, m.sendDuration, m.relatedItems, m.queueDepth, m.redeliveries)
+	return m
+}
+
+func (m *pipelineMetrics) countMessage(outcome string) {
+	if m == nil {
+		return
+	}
+	m.messages.WithLabelValues(outcome).Inc()
+}
+
+func (m *pipelineMetrics) countFiltered(rule string) {
+	if m == nil {
+		return
+	}
+	m.filtered.WithLabelValues(rule).Inc()
+}
+
+func (m *pipelineMetrics) countViolations(violations []Violation) {
+	if m == nil {
+		return
+	}
+	for _, v := range violations {
+		m.violations.WithLabelValues(v.Keyword).Inc()
+	}
+}
+
+func (m *pipelineMetrics) observeMapping(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.mappingDuration.Observe(time.Since(start).Seconds())
+}
+
+func (m *pipelineMetrics) observeSend(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.sendDuration.Observe(time.Since(start).Seconds())
+}
+
+func (m *pipelineMetrics) setRelatedItems(count int) {
+	if m == nil {
+		return
+	}
+	m.relatedItems.Set(float64(count))
+}
+
+func (m *pipelineMetrics) setQueueDepth(worker string, depth int) {
+	if m == nil {
+		return
+	}
+	m.queueDepth.WithLabelValues(worker).Set(float64(depth))
+}
+
+func (m *pipelineMetrics) countRedelivery() {
+	if m == nil {
+		return
+	}
+	m.redeliveries.Inc()
+}
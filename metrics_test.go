@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueConsumeMetrics(t *testing.T) {
+	metrics := newPipelineMetrics(prometheus.NewRegistry())
+	h := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMessageProducer{},
+		metrics:         metrics,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	messages := []struct {
+		fileName     string
+		originSystem string
+		contentType  string
+	}{
+		{"next-video-input.json", nextVideoOrigin, "application/json"},
+		{"next-video-input.json", nextVideoOrigin, "application/json"},
+		{"next-video-input.json", "other", "application/json"},
+		{"next-video-input.json", nextVideoOrigin, "audio"},
+		{"invalid-format.json", nextVideoOrigin, "application/json"},
+		{"next-video-delete-input.json", nextVideoOrigin, "application/json"},
+	}
+	for _, msg := range messages {
+		h.queueConsume(kafka.FTMessage{
+			Headers: createHeaders(msg.originSystem, msg.contentType, "1234", lastModified),
+			Body:    string(getBytes(msg.fileName, t)),
+		})
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeProduced)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeIgnoredOrigin)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeIgnoredContentType)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeMappingFailed)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeDeleted)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeProduceFailed)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.relatedItems))
+}
+
+func TestNilPipelineMetrics(t *testing.T) {
+	var metrics *pipelineMetrics
+	assert.NotPanics(t, func() {
+		metrics.countMessage(outcomeProduced)
+		metrics.setRelatedItems(1)
+	})
+}
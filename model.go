@@ -1,8 +1,11 @@
 package main
 
+import "encoding/json"
+
 // ContentCollection holds items information
 type ContentCollection struct {
 	UUID             string `json:"uuid,omitempty"`
+	VideoUUID        string `json:"videoUuid,omitempty"`
 	Items            []Item `json:"items,omitempty"`
 	PublishReference string `json:"publishReference,omitempty"`
 	LastModified     string `json:"lastModified,omitempty"`
@@ -10,9 +13,24 @@ type ContentCollection struct {
 	Deleted          bool   `json:"deleted,omitempty"`
 }
 
+// MarshalJSON writes the items of a collection even when there are none, so an emptied story package is explicit.
+// Collections without an items list, like the deleted ones, leave them out.
+func (cc ContentCollection) MarshalJSON() ([]byte, error) {
+	type contentCollection ContentCollection
+	if cc.Items == nil || len(cc.Items) > 0 {
+		return json.Marshal(contentCollection(cc))
+	}
+	return json.Marshal(struct {
+		contentCollection
+		Items []Item `json:"items"`
+	}{contentCollection(cc), cc.Items})
+}
+
 // Item within content collection
 type Item struct {
-	UUID string `json:"uuid,omitempty"`
+	UUID       string                 `json:"uuid,omitempty"`
+	Position   int                    `json:"position,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
 }
 
 // MappedContent top level type
@@ -22,3 +40,71 @@ type MappedContent struct {
 	LastModified string            `json:"lastModified,omitempty"`
 	UUID         string            `json:"uuid,omitempty"`
 }
+
+// StoryPackageRelationship links a video to the story package holding its related content
+type StoryPackageRelationship struct {
+	VideoUUID        string `json:"videoUuid"`
+	StoryPackageUUID string `json:"storyPackageUuid"`
+	PublishReference string `json:"publishReference"`
+	LastModified     string `json:"lastModified"`
+	Deleted          bool   `json:"deleted,omitempty"`
+}
+
+// DeadLetter wraps a native message that could not be processed, for inspection and replay
+type DeadLetter struct {
+	Body     string            `json:"body"`
+	Headers  map[string]string `json:"headers"`
+	Reason   string            `json:"reason"`
+	Stage    string            `json:"stage"`
+	FailedAt string            `json:"failedAt"`
+}
+
+// ItemRejection reports a related item left out of the story package
+type ItemRejection struct {
+	Index  int    `json:"index"`
+	UUID   string `json:"uuid,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// MapReport holds the mapped content together with the related items left out of it
+type MapReport struct {
+	Content       json.RawMessage `json:"content"`
+	RejectedItems []ItemRejection `json:"rejectedItems"`
+}
+
+// ReplayResult describes the message built by a replay request
+type ReplayResult struct {
+	DryRun        bool              `json:"dryRun"`
+	Headers       map[string]string `json:"headers"`
+	Content       json.RawMessage   `json:"content"`
+	Relationship  json.RawMessage   `json:"relationship,omitempty"`
+	RejectedItems []ItemRejection   `json:"rejectedItems,omitempty"`
+}
+
+// BatchResult holds the outcome of mapping one document of a batch
+type BatchResult struct {
+	Index      int             `json:"index"`
+	Content    json.RawMessage `json:"content,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Code       string          `json:"code,omitempty"`
+	Field      string          `json:"field,omitempty"`
+	Violations []Violation     `json:"violations,omitempty"`
+}
+
+// Problem is a JSON problem document (RFC 7807) describing why a request failed
+type Problem struct {
+	Type       string      `json:"type"`
+	Title      string      `json:"title"`
+	Status     int         `json:"status"`
+	Detail     string      `json:"detail"`
+	Code       string      `json:"code"`
+	Field      string      `json:"field,omitempty"`
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// Violation describes a part of a native payload that doesn't match its schema
+type Violation struct {
+	Field   string `json:"field"`
+	Keyword string `json:"keyword"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,117 @@
+// Package nativevideo models the video documents published or deleted by the Next video editor.
+package nativevideo
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	deletedField       = "deleted"
+	relatedItemIDField = "uuid"
+)
+
+// Video is a video document published or deleted by the Next video editor.
+// Unknown fields are ignored and known fields holding values of an unexpected type are left empty,
+// so a document can always be decoded as long as it is a JSON object.
+type Video struct {
+	ID   string `json:"id,omitempty"`
+	UUID string `json:"uuid,omitempty"`
+	// Deleted is set when the document holds a deleted field, whatever its value, as that is how delete events are told apart.
+	Deleted          bool          `json:"deleted,omitempty"`
+	Related          []RelatedItem `json:"related,omitempty"`
+	LastModified     string        `json:"lastModified,omitempty"`
+	PublishReference string        `json:"publishReference,omitempty"`
+	Type             string        `json:"type,omitempty"`
+	Title            string        `json:"title,omitempty"`
+	Standfirst       string        `json:"standfirst,omitempty"`
+	Description      string        `json:"description,omitempty"`
+	Byline           string        `json:"byline,omitempty"`
+	Image            string        `json:"image,omitempty"`
+	IsPublished      bool          `json:"isPublished,omitempty"`
+	CanBeSyndicated  bool          `json:"canBeSyndicated,omitempty"`
+	CreatedAt        string        `json:"createdAt,omitempty"`
+	UpdatedAt        string        `json:"updatedAt,omitempty"`
+	Encoding         *Encoding     `json:"encoding,omitempty"`
+	Annotations      []Annotation  `json:"annotations,omitempty"`
+
+	// document holds the whole decoded JSON object, for the fields not modelled here and for schema validation.
+	document map[string]interface{}
+}
+
+// RelatedItem is a piece of content the video is related to
+type RelatedItem struct {
+	UUID  string `json:"uuid,omitempty"`
+	Title string `json:"title,omitempty"`
+
+	// Fields holds all the fields of the item, including the ones not modelled here.
+	// It is nil when the item is not a JSON object.
+	Fields map[string]interface{} `json:"-"`
+}
+
+// Encoding describes the renditions of the video
+type Encoding struct {
+	Job     int64            `json:"job,omitempty"`
+	Status  string           `json:"status,omitempty"`
+	Outputs []EncodingOutput `json:"outputs,omitempty"`
+}
+
+// EncodingOutput is a rendition of the video
+type EncodingOutput struct {
+	URL        string `json:"url,omitempty"`
+	MediaType  string `json:"mediaType,omitempty"`
+	Duration   int64  `json:"duration,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	AudioCodec string `json:"audioCodec,omitempty"`
+	VideoCodec string `json:"videoCodec,omitempty"`
+}
+
+// Annotation links the video to a concept
+type Annotation struct {
+	ID        string `json:"id,omitempty"`
+	Predicate string `json:"predicate,omitempty"`
+}
+
+// UnmarshalJSON decodes a native video, failing only when the data is not a JSON object.
+func (v *Video) UnmarshalJSON(data []byte) error {
+	var document map[string]interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return err
+	}
+
+	type video Video
+	var decoded video
+	var typeErr *json.UnmarshalTypeError
+	if err := json.Unmarshal(data, &decoded); err != nil && !errors.As(err, &typeErr) {
+		return err
+	}
+
+	*v = Video(decoded)
+	_, v.Deleted = document[deletedField]
+	v.document = document
+	return nil
+}
+
+// Document returns the whole decoded JSON object of the video, nil when the video was not decoded from JSON.
+func (v Video) Document() map[string]interface{} {
+	return v.document
+}
+
+// UnmarshalJSON decodes a related item, leaving it empty when it is not a JSON object.
+func (i *RelatedItem) UnmarshalJSON(data []byte) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	*i = NewRelatedItem(fields, relatedItemIDField)
+	return nil
+}
+
+// NewRelatedItem builds a related item from its fields, reading its UUID from idField.
+func NewRelatedItem(fields map[string]interface{}, idField string) RelatedItem {
+	item := RelatedItem{Fields: fields}
+	item.UUID, _ = fields[idField].(string)
+	item.Title, _ = fields["title"].(string)
+	return item
+}
@@ -0,0 +1,108 @@
+package nativevideo
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testVideoUUID = "e2290d14-7e80-4db8-a715-949da4de9a07"
+
+func readContent(fileName string) (Video, error) {
+	var result Video
+	data, err := os.ReadFile("../test-resources/" + fileName)
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+func TestDecodeVideo(t *testing.T) {
+	video, err := readContent("next-video-input.json")
+	assert.NoError(t, err)
+
+	assert.Equal(t, testVideoUUID, video.ID)
+	assert.False(t, video.Deleted)
+	assert.Equal(t, "video", video.Type)
+	assert.Equal(t, "Trump trade under scrutiny", video.Title)
+	assert.Equal(t, "2017-04-03T16:30:11.106Z", video.UpdatedAt)
+	assert.True(t, video.CanBeSyndicated)
+	if assert.Len(t, video.Related, 1) {
+		assert.Equal(t, "c4cde316-128c-11e7-80f4-13e067d5072c", video.Related[0].UUID)
+		assert.Equal(t, "Stocks and dollar slide as ‘Trump trade’ fades", video.Related[0].Title)
+		assert.Equal(t, video.Related[0].Title, video.Related[0].Fields["title"])
+	}
+	if assert.NotNil(t, video.Encoding) {
+		assert.Equal(t, "COMPLETE", video.Encoding.Status)
+		assert.Len(t, video.Encoding.Outputs, 3)
+		assert.Equal(t, 1280, video.Encoding.Outputs[2].Width)
+	}
+	assert.Equal(t, []Annotation{
+		{ID: "http://api.ft.com/things/71a5efa5-e6e0-3ce1-9190-a7eac8bef325", Predicate: "http://www.ft.com/ontology/classification/isClassifiedBy"},
+	}, video.Annotations)
+	assert.Equal(t, "58d8d6cc789d4c000f6b0169", video.Document()["_id"])
+
+	deleted, err := readContent("next-video-delete-input.json")
+	assert.NoError(t, err)
+	assert.Equal(t, testVideoUUID, deleted.UUID)
+	assert.True(t, deleted.Deleted)
+	assert.Equal(t, "2017-04-04T14:42:58.920Z", deleted.LastModified)
+	assert.Equal(t, "tid_bycjmmcj4r", deleted.PublishReference)
+}
+
+func TestDecodeVideoTolerance(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		expectedVideo Video
+		expectedIsErr bool
+	}{
+		{
+			"unknown fields",
+			`{"id":"e2290d14-7e80-4db8-a715-949da4de9a07","unknown":{"nested":[1,2]}}`,
+			Video{ID: testVideoUUID},
+			false,
+		},
+		{
+			"fields of unexpected types",
+			`{"id":"e2290d14-7e80-4db8-a715-949da4de9a07","title":1,"isPublished":"no","related":["test",{"uuid":1}]}`,
+			Video{ID: testVideoUUID, Related: []RelatedItem{{}, {Fields: map[string]interface{}{"uuid": 1.0}}}},
+			false,
+		},
+		{
+			"deleted field of unexpected type",
+			`{"uuid":"e2290d14-7e80-4db8-a715-949da4de9a07","deleted":"yes"}`,
+			Video{UUID: testVideoUUID, Deleted: true},
+			false,
+		},
+		{
+			"not an object",
+			`["e2290d14-7e80-4db8-a715-949da4de9a07"]`,
+			Video{},
+			true,
+		},
+		{
+			"invalid JSON",
+			`{"id":`,
+			Video{},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var video Video
+			err := json.Unmarshal([]byte(test.body), &video)
+			assert.Equal(t, test.expectedIsErr, err != nil)
+			if err != nil {
+				return
+			}
+			video.document = nil
+			assert.Equal(t, test.expectedVideo, video)
+		})
+	}
+}
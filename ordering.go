@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// forceHeader marks a message to be sent even if it is older than the last one sent for its story package,
+// or unchanged since it was last sent.
+const forceHeader = "X-Force-Replay"
+
+// orderingGuard remembers the Message-Timestamp of the last message sent for each story package,
+// so older versions of a video redelivered or replayed later don't overwrite newer story packages.
+// Messages up to tolerance older than the last one sent are still accepted.
+// A nil *orderingGuard accepts every message.
+type orderingGuard struct {
+	tolerance time.Duration
+	mu        sync.Mutex
+	last      *lru[time.Time]
+}
+
+// newOrderingGuard creates a guard remembering up to size story packages. A size lower than 1 disables the guard.
+func newOrderingGuard(size int, tolerance time.Duration) *orderingGuard {
+	if size < 1 {
+		return nil
+	}
+	return &orderingGuard{tolerance: tolerance, last: newLRU[time.Time](size)}
+}
+
+// staleError reports a message older than the last one sent for its story package.
+type staleError struct {
+	timestamp time.Time
+	last      time.Time
+}
+
+func (e *staleError) Error() string {
+	return fmt.Sprintf("message timestamp %s is older than the one of the last message sent for the story package, %s",
+		e.timestamp.Format(dateFormat), e.last.Format(dateFormat))
+}
+
+// check returns a staleError when the message timestamp is older than the last one sent for the story package,
+// beyond the tolerance.
+func (g *orderingGuard) check(key string, timestamp time.Time) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	last, ok := g.last.get(key)
+	if ok && timestamp.Add(g.tolerance).Before(last) {
+		return &staleError{timestamp: timestamp, last: last}
+	}
+	return nil
+}
+
+// record remembers the timestamp of a message sent for the story package, unless a newer one was already sent.
+func (g *orderingGuard) record(key string, timestamp time.Time) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if last, ok := g.last.get(key); ok && last.After(timestamp) {
+		return
+	}
+	g.last.put(key, timestamp)
+}
+
+// isForced tells whether the value of the force header asks to skip the ordering and idempotency checks.
+func isForced(value string) bool {
+	forced, _ := strconv.ParseBool(value)
+	return forced
+}
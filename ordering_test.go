@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderingGuard(t *testing.T) {
+	now := time.Date(2017, 4, 4, 14, 42, 58, 920000000, time.UTC)
+	g := newOrderingGuard(10, time.Second)
+
+	assert.NoError(t, g.check("a", now), "First message should be accepted")
+	g.record("a", now)
+
+	assert.NoError(t, g.check("a", now.Add(time.Minute)), "Newer message should be accepted")
+	assert.NoError(t, g.check("a", now), "Message with the same timestamp should be accepted")
+	assert.NoError(t, g.check("a", now.Add(-time.Second)), "Message within the tolerance should be accepted")
+	assert.NoError(t, g.check("b", now.Add(-time.Hour)), "Messages of other story packages should be accepted")
+
+	err := g.check("a", now.Add(-time.Minute))
+	assert.IsType(t, &staleError{}, err, "Older message should be rejected")
+
+	g.record("a", now.Add(-time.Hour))
+	assert.Error(t, g.check("a", now.Add(-time.Minute)), "Recording an older message should not move the last timestamp back")
+}
+
+func TestDisabledOrderingGuard(t *testing.T) {
+	g := newOrderingGuard(0, 0)
+	assert.Nil(t, g)
+
+	g.record("a", time.Now())
+	assert.NoError(t, g.check("a", time.Now().Add(-time.Hour)))
+}
+
+func TestQueueConsumeOrdering(t *testing.T) {
+	newer := "2017-04-04T14:42:58.920Z"
+	older := "2017-04-04T14:40:00.000Z"
+	tests := []struct {
+		name            string
+		timestamps      []string
+		forced          bool
+		expectedStale   bool
+		expectedContent string
+	}{
+		{
+			"in order",
+			[]string{older, newer},
+			false,
+			false,
+			newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", newer, false),
+		},
+		{
+			"out of order",
+			[]string{newer, older},
+			false,
+			true,
+			newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", newer, false),
+		},
+		{
+			"forced replay",
+			[]string{newer, older},
+			true,
+			false,
+			newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", older, false),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			staleSink := mockFailureSink{}
+			mockMsgProducer := mockMessageProducer{}
+			metrics := newPipelineMetrics(prometheus.NewRegistry())
+			h := queueHandler{
+				sc:              serviceConfig{},
+				messageProducer: &mockMsgProducer,
+				staleSink:       &staleSink,
+				ordering:        newOrderingGuard(10, 0),
+				metrics:         metrics,
+				log:             logger.NewUPPLogger("video-mapper", "Debug"),
+			}
+
+			for i, timestamp := range test.timestamps {
+				headers := createHeaders(nextVideoOrigin, "application/json", "1234", timestamp)
+				if test.forced && i == len(test.timestamps)-1 {
+					headers[forceHeader] = "true"
+				}
+				h.queueConsume(kafka.FTMessage{Headers: headers, Body: string(getBytes("next-video-input.json", t))})
+			}
+
+			assert.Equal(t, test.expectedStale, staleSink.parkCalled, "Stale check is wrong")
+			assert.Equal(t, test.expectedContent, mockMsgProducer.message, "Last sent content is wrong")
+			if test.expectedStale {
+				assert.Equal(t, stageStale, staleSink.stage)
+				assert.Equal(t, 1.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeStale)))
+			}
+		})
+	}
+}
+
+func TestQueueConsumeForcedReplayOfUnchangedStoryPackage(t *testing.T) {
+	dedup, _ := newTestDedupCache(t, 10, "")
+	mockMsgProducer := mockMessageProducer{}
+	h := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		dedup:           dedup,
+		ordering:        newOrderingGuard(10, 0),
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	headers := createHeaders(nextVideoOrigin, "application/json", "1234", lastModified)
+	h.queueConsume(kafka.FTMessage{Headers: headers, Body: string(getBytes("next-video-input.json", t))})
+
+	mockMsgProducer.sendCalled = false
+	headers = createHeaders(nextVideoOrigin, "application/json", "1234", lastModified)
+	headers[forceHeader] = "true"
+	h.queueConsume(kafka.FTMessage{Headers: headers, Body: string(getBytes("next-video-input.json", t))})
+
+	assert.True(t, mockMsgProducer.sendCalled, "Forced replay should be sent even if the story package is unchanged")
+}
+
+func TestReplayRequestOrdering(t *testing.T) {
+	newer := "2017-04-04T14:42:58.920Z"
+	older := "2017-04-04T14:40:00.000Z"
+	mockMsgProducer := mockMessageProducer{}
+	staleSink := mockFailureSink{}
+	ordering := newOrderingGuard(10, 0)
+	qh := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		staleSink:       &staleSink,
+		ordering:        ordering,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+	sh := serviceHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		ordering:        ordering,
+		log:             qh.log,
+	}
+	replay := func(timestamp string, forced bool) *httptest.ResponseRecorder {
+		mockMsgProducer.sendCalled = false
+		req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/replay", getReader("next-video-input.json", t))
+		req.Header.Set("X-Request-Id", "1234")
+		req.Header.Set("Message-Timestamp", timestamp)
+		if forced {
+			req.Header.Set(forceHeader, "true")
+		}
+		w := httptest.NewRecorder()
+		sh.replayRequest(w, req)
+		return w
+	}
+
+	qh.queueConsume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", newer),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+
+	w := replay(older, false)
+	assert.Equal(t, http.StatusConflict, w.Code, "Replay older than the last message sent should be rejected")
+	assert.Contains(t, w.Body.String(), errCodeStale)
+	assert.False(t, mockMsgProducer.sendCalled)
+
+	w = replay(older, true)
+	assert.Equal(t, http.StatusOK, w.Code, "Forced replay should skip the ordering check")
+	assert.True(t, mockMsgProducer.sendCalled)
+
+	w = replay("2017-04-04T14:50:00.000Z", false)
+	assert.Equal(t, http.StatusOK, w.Code)
+	qh.queueConsume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", newer),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+	assert.True(t, staleSink.parkCalled, "Consumed message older than the last replay should be stale")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// originProfile describes where the video and related item fields are found in the payloads of an origin system.
+type originProfile struct {
+	Origin             string `json:"origin"`
+	IDField            string `json:"idField,omitempty"`
+	DeletedIDField     string `json:"deletedIdField,omitempty"`
+	RelatedField       string `json:"relatedField,omitempty"`
+	RelatedItemIDField string `json:"relatedItemIdField,omitempty"`
+	Schema             string `json:"schema,omitempty"`
+}
+
+var defaultOriginProfile = originProfile{
+	Origin:             nextVideoOrigin,
+	IDField:            videoIDField,
+	DeletedIDField:     videoUUIDField,
+	RelatedField:       relatedField,
+	RelatedItemIDField: relatedItemIDField,
+}
+
+// withDefaults fills the fields left empty with the ones of the Next video payloads.
+func (p originProfile) withDefaults() originProfile {
+	if p.IDField == "" {
+		p.IDField = defaultOriginProfile.IDField
+	}
+	if p.DeletedIDField == "" {
+		p.DeletedIDField = defaultOriginProfile.DeletedIDField
+	}
+	if p.RelatedField == "" {
+		p.RelatedField = defaultOriginProfile.RelatedField
+	}
+	if p.RelatedItemIDField == "" {
+		p.RelatedItemIDField = defaultOriginProfile.RelatedItemIDField
+	}
+	return p
+}
+
+// hasDefaultFields tells whether the payloads of the origin are read with the fields of the Next video payloads.
+func (p originProfile) hasDefaultFields() bool {
+	p = p.withDefaults()
+	return p.IDField == defaultOriginProfile.IDField &&
+		p.DeletedIDField == defaultOriginProfile.DeletedIDField &&
+		p.RelatedField == defaultOriginProfile.RelatedField &&
+		p.RelatedItemIDField == defaultOriginProfile.RelatedItemIDField
+}
+
+// originProfiles holds the accepted origin systems, keyed by Origin-System-Id.
+type originProfiles map[string]originProfile
+
+func newOriginProfiles(profiles ...originProfile) originProfiles {
+	result := make(originProfiles, len(profiles))
+	for _, p := range profiles {
+		result[p.Origin] = p.withDefaults()
+	}
+	return result
+}
+
+// parseOriginProfiles reads a JSON array of origin profiles.
+// An empty configuration accepts only the Next video editor.
+func parseOriginProfiles(config string) (originProfiles, error) {
+	if config == "" {
+		return newOriginProfiles(defaultOriginProfile), nil
+	}
+
+	var profiles []originProfile
+	if err := json.Unmarshal([]byte(config), &profiles); err != nil {
+		return nil, fmt.Errorf("origin profiles configuration is not a valid JSON array: %w", err)
+	}
+	for i, p := range profiles {
+		if p.Origin == "" {
+			return nil, fmt.Errorf("origin profile at index %d has no origin", i)
+		}
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("origin profiles configuration has no profiles")
+	}
+	return newOriginProfiles(profiles...), nil
+}
+
+// lookup returns the profile of the given origin. A nil set of profiles accepts only the Next video editor.
+func (p originProfiles) lookup(origin string) (originProfile, bool) {
+	if p == nil {
+		return defaultOriginProfile, origin == nextVideoOrigin
+	}
+	profile, ok := p[origin]
+	return profile, ok
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOriginProfiles(t *testing.T) {
+	audioOrigin := "http://cmdb.ft.com/systems/audio-editor"
+	tests := []struct {
+		config        string
+		origin        string
+		expected      originProfile
+		expectedFound bool
+		expectedIsErr bool
+	}{
+		{
+			"",
+			nextVideoOrigin,
+			defaultOriginProfile,
+			true,
+			false,
+		},
+		{
+			"",
+			audioOrigin,
+			originProfile{},
+			false,
+			false,
+		},
+		{
+			`[{"origin":"http://cmdb.ft.com/systems/audio-editor","idField":"audioId","relatedField":"links"}]`,
+			audioOrigin,
+			originProfile{Origin: audioOrigin, IDField: "audioId", DeletedIDField: "uuid", RelatedField: "links", RelatedItemIDField: "uuid"},
+			true,
+			false,
+		},
+		{
+			`[{"origin":"http://cmdb.ft.com/systems/audio-editor"}]`,
+			nextVideoOrigin,
+			originProfile{},
+			false,
+			false,
+		},
+		{
+			`[{"idField":"audioId"}]`,
+			"",
+			originProfile{},
+			false,
+			true,
+		},
+		{
+			`[]`,
+			"",
+			originProfile{},
+			false,
+			true,
+		},
+		{
+			`{"origin":"test"}`,
+			"",
+			originProfile{},
+			false,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		profiles, err := parseOriginProfiles(test.config)
+		assert.Equal(t, test.expectedIsErr, err != nil, "Error status is wrong. Config: %s", test.config)
+		if err != nil {
+			continue
+		}
+		profile, found := profiles.lookup(test.origin)
+		assert.Equal(t, test.expectedFound, found, "Origin lookup is wrong. Config: %s, origin: %s", test.config, test.origin)
+		assert.Equal(t, test.expected, profile, "Profile is wrong. Config: %s, origin: %s", test.config, test.origin)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/Financial-Times/kafka-client-go/v3"
+)
+
+// workerPool processes the consumed messages concurrently on a fixed number of workers.
+// The messages are sharded by key: the ones with the same key go to the same worker and are processed in arrival order.
+// A nil *workerPool is valid and has nothing pending.
+type workerPool struct {
+	shards  []chan poolJob
+	key     func(kafka.FTMessage) string
+	handle  func(kafka.FTMessage) error
+	metrics *pipelineMetrics
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+	stopped sync.Once
+}
+
+// poolJob is a message waiting for a worker, with the channel its processing result is sent on.
+type poolJob struct {
+	message kafka.FTMessage
+	result  chan error
+}
+
+// newWorkerPool starts the workers, each with a queue of queueSize messages.
+// It returns nil for less than two workers, as the consumer is then better off processing the messages itself.
+func newWorkerPool(workers, queueSize int, key func(kafka.FTMessage) string, handle func(kafka.FTMessage) error, metrics *pipelineMetrics) *workerPool {
+	if workers < 2 {
+		return nil
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	p := &workerPool{
+		shards:  make([]chan poolJob, workers),
+		key:     key,
+		handle:  handle,
+		metrics: metrics,
+	}
+	for i := range p.shards {
+		p.shards[i] = make(chan poolJob, queueSize)
+		p.workers.Add(1)
+		go p.work(i)
+	}
+	return p
+}
+
+// submit queues the message on the worker of its key, blocking while that worker's queue is full.
+// The returned channel receives the result of processing the message; it is buffered, so it can be ignored.
+func (p *workerPool) submit(m kafka.FTMessage) <-chan error {
+	i := p.shard(p.key(m))
+	job := poolJob{message: m, result: make(chan error, 1)}
+	p.pending.Add(1)
+	p.shards[i] <- job
+	p.metrics.setQueueDepth(strconv.Itoa(i), len(p.shards[i]))
+	return job.result
+}
+
+func (p *workerPool) shard(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.shards)))
+}
+
+func (p *workerPool) work(i int) {
+	defer p.workers.Done()
+	worker := strconv.Itoa(i)
+	for job := range p.shards[i] {
+		p.metrics.setQueueDepth(worker, len(p.shards[i]))
+		job.result <- p.handle(job.message)
+		p.pending.Done()
+	}
+}
+
+// wait blocks until all the submitted messages are processed.
+func (p *workerPool) wait() {
+	if p == nil {
+		return
+	}
+	p.pending.Wait()
+}
+
+// stop lets the workers finish the queued messages and waits for them to exit. Nothing can be submitted afterwards.
+// Stopping the pool again has no effect.
+func (p *workerPool) stop() {
+	if p == nil {
+		return
+	}
+	p.stopped.Do(func() {
+		for _, shard := range p.shards {
+			close(shard)
+		}
+	})
+	p.workers.Wait()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func keyedMessage(key string, seq int) kafka.FTMessage {
+	return kafka.FTMessage{Headers: map[string]string{"Key": key}, Body: strconv.Itoa(seq)}
+}
+
+func messageHeaderKey(m kafka.FTMessage) string {
+	return m.Headers["Key"]
+}
+
+func TestWorkerPoolKeepsKeyOrder(t *testing.T) {
+	var mu sync.Mutex
+	processed := make(map[string][]int)
+	p := newWorkerPool(4, 2, messageHeaderKey, func(m kafka.FTMessage) error {
+		seq, _ := strconv.Atoi(m.Body)
+		time.Sleep(time.Duration(seq%3) * time.Millisecond)
+		mu.Lock()
+		processed[m.Headers["Key"]] = append(processed[m.Headers["Key"]], seq)
+		mu.Unlock()
+		return nil
+	}, nil)
+	defer p.stop()
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for seq := 0; seq < 20; seq++ {
+		for _, key := range keys {
+			p.submit(keyedMessage(key, seq))
+		}
+	}
+	p.wait()
+
+	for _, key := range keys {
+		assert.Len(t, processed[key], 20, "Messages of key %s", key)
+		for i, seq := range processed[key] {
+			assert.Equal(t, i, seq, "Messages of key %s should be processed in arrival order", key)
+		}
+	}
+}
+
+func TestWorkerPoolProcessesKeysConcurrently(t *testing.T) {
+	release := make(chan struct{})
+	done := make(chan string, 1)
+	p := newWorkerPool(2, 1, messageHeaderKey, func(m kafka.FTMessage) error {
+		if m.Headers["Key"] == "blocked" {
+			<-release
+			return nil
+		}
+		done <- m.Headers["Key"]
+		return nil
+	}, nil)
+	defer p.stop()
+
+	other := ""
+	for i := 0; other == ""; i++ {
+		if key := fmt.Sprintf("key-%d", i); p.shard(key) != p.shard("blocked") {
+			other = key
+		}
+	}
+
+	p.submit(keyedMessage("blocked", 0))
+	p.submit(keyedMessage(other, 0))
+
+	select {
+	case key := <-done:
+		assert.Equal(t, other, key)
+	case <-time.After(time.Second):
+		assert.Fail(t, "A message on another worker should not wait for the blocked one")
+	}
+	close(release)
+	p.wait()
+}
+
+func TestWorkerPoolQueueDepth(t *testing.T) {
+	metrics := newPipelineMetrics(prometheus.NewRegistry())
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	p := newWorkerPool(2, 5, messageHeaderKey, func(m kafka.FTMessage) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, metrics)
+	defer p.stop()
+
+	for seq := 0; seq < 3; seq++ {
+		p.submit(keyedMessage("a", seq))
+	}
+	<-started
+	worker := strconv.Itoa(p.shard("a"))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.queueDepth.WithLabelValues(worker)), "Messages waiting behind the one being processed")
+
+	close(release)
+	p.wait()
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.queueDepth.WithLabelValues(worker)))
+}
+
+func TestWorkerPoolResult(t *testing.T) {
+	p := newWorkerPool(2, 1, messageHeaderKey, func(m kafka.FTMessage) error {
+		if m.Body == "1" {
+			return errors.New("processing failed")
+		}
+		return nil
+	}, nil)
+	defer p.stop()
+
+	assert.NoError(t, <-p.submit(keyedMessage("a", 0)))
+	assert.EqualError(t, <-p.submit(keyedMessage("a", 1)), "processing failed")
+}
+
+func TestNewWorkerPoolSingleWorker(t *testing.T) {
+	p := newWorkerPool(1, 10, messageHeaderKey, func(kafka.FTMessage) error { return nil }, nil)
+	assert.Nil(t, p, "A single worker should not need a pool")
+	assert.NotPanics(t, func() {
+		p.wait()
+		p.stop()
+	})
+}
+
+func TestWorkerPoolStopTwice(t *testing.T) {
+	p := newWorkerPool(2, 1, messageHeaderKey, func(kafka.FTMessage) error { return nil }, nil)
+	p.stop()
+	assert.NotPanics(t, p.stop, "Stopping the pool again should have no effect")
+}
+
+func TestMessageKey(t *testing.T) {
+	h := queueHandler{
+		origins: newOriginProfiles(defaultOriginProfile, originProfile{Origin: "other", IDField: "videoId"}),
+	}
+
+	tests := []struct {
+		name        string
+		origin      string
+		body        string
+		expectedKey string
+	}{
+		{"publish", nextVideoOrigin, `{"id": "E2290D14-7E80-4DB8-A715-949DA4DE9A07"}`, "e2290d14-7e80-4db8-a715-949da4de9a07"},
+		{"delete", nextVideoOrigin, `{"uuid": "e2290d14-7e80-4db8-a715-949da4de9a07", "deleted": true}`, "e2290d14-7e80-4db8-a715-949da4de9a07"},
+		{"origin profile", "other", `{"videoId": "e2290d14-7e80-4db8-a715-949da4de9a07"}`, "e2290d14-7e80-4db8-a715-949da4de9a07"},
+		{"missing field", nextVideoOrigin, `{"uuid": "e2290d14-7e80-4db8-a715-949da4de9a07"}`, ""},
+		{"wrong field type", nextVideoOrigin, `{"id": 1}`, ""},
+		{"invalid JSON", nextVideoOrigin, `{`, ""},
+		{"unsupported origin", "unknown", `{"id": "e2290d14-7e80-4db8-a715-949da4de9a07"}`, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := h.messageKey(kafka.FTMessage{Headers: map[string]string{"Origin-System-Id": test.origin}, Body: test.body})
+			assert.Equal(t, test.expectedKey, key)
+		})
+	}
+}
+
+func TestQueueConsumeWithWorkerPool(t *testing.T) {
+	producer := &recordingMessageProducer{}
+	h := &queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: producer,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+	h.pool = newWorkerPool(3, 10, h.messageKey, h.queueConsume, nil)
+	defer h.pool.stop()
+
+	files := []string{"next-video-input.json", "next-video-delete-input.json", "next-video-no-related-input.json", "invalid-format.json"}
+	for _, fileName := range files {
+		h.consume(kafka.FTMessage{
+			Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+			Body:    string(getBytes(fileName, t)),
+		})
+	}
+
+	assert.NoError(t, h.drain(context.Background()))
+	assert.Len(t, producer.messages, 3, "The valid messages should be sent once drained")
+	for _, shard := range h.pool.shards {
+		_, open := <-shard
+		assert.False(t, open, "Workers should be stopped once drained")
+	}
+}
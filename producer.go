@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/Shopify/sarama"
+)
+
+// Kafka message keys of the sent story packages.
+const (
+	messageKeyCollection = "collection"
+	messageKeyVideo      = "video"
+	messageKeyNone       = "none"
+)
+
+// keyedMessageProducer sends messages with a Kafka message key,
+// so that the messages with the same key go to the same partition and are consumed in order.
+type keyedMessageProducer interface {
+	messageProducer
+	SendKeyedMessage(key string, message kafka.FTMessage) error
+}
+
+// sendMessage sends the message with the given key when there is one and the producer supports keys, without a key otherwise.
+func sendMessage(p messageProducer, key string, message kafka.FTMessage) error {
+	if kp, ok := p.(keyedMessageProducer); ok && key != "" {
+		return kp.SendKeyedMessage(key, message)
+	}
+	return p.SendMessage(message)
+}
+
+// partitionKey returns the Kafka message key of the story package, following the message key policy.
+func (m *relatedContentMapper) partitionKey() string {
+	switch m.sc.messageKey {
+	case messageKeyVideo:
+		return m.videoUUID()
+	case messageKeyNone:
+		return ""
+	default:
+		return m.storyPackageUUID
+	}
+}
+
+// Bounds of the interval between the attempts to connect, as in kafka.Producer.
+const (
+	defaultConnectionRetryInterval = time.Minute
+	maxConnectionRetryInterval     = 5 * time.Minute
+)
+
+var errProducerClosed = errors.New("producer is closed")
+
+// keyedProducer is a Kafka producer like kafka.Producer that can also set the message key.
+// It keeps trying to connect in the background until it succeeds.
+// Unlike kafka.Producer, sending after Close fails instead of panicking.
+type keyedProducer struct {
+	config   kafka.ProducerConfig
+	lock     sync.RWMutex
+	producer sarama.SyncProducer
+	closed   bool
+	log      *logger.UPPLogger
+}
+
+func newKeyedProducer(config kafka.ProducerConfig, log *logger.UPPLogger) *keyedProducer {
+	p := &keyedProducer{config: config, log: log}
+	go p.connect()
+	return p
+}
+
+func (p *keyedProducer) connect() {
+	log := p.log.WithField("brokers", p.config.BrokersConnectionString).WithField("topic", p.config.Topic)
+
+	interval := connectionRetryInterval(p.config)
+	for {
+		if p.isClosed() {
+			return
+		}
+		producer, err := newSyncProducer(p.config)
+		if err == nil {
+			log.Info("Connected to Kafka producer")
+			p.setProducer(producer)
+			return
+		}
+
+		log.WithError(err).Warn("Error creating Kafka producer")
+		time.Sleep(interval)
+	}
+}
+
+// connectionRetryInterval returns the configured interval between the attempts to connect,
+// or the default one when it is not set or longer than the maximum.
+func connectionRetryInterval(config kafka.ProducerConfig) time.Duration {
+	interval := config.ConnectionRetryInterval
+	if interval <= 0 || interval > maxConnectionRetryInterval {
+		return defaultConnectionRetryInterval
+	}
+	return interval
+}
+
+// setProducer sets the connected producer, closing it straight away when the keyedProducer was closed meanwhile.
+func (p *keyedProducer) setProducer(producer sarama.SyncProducer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		_ = producer.Close()
+		return
+	}
+	p.producer = producer
+}
+
+func (p *keyedProducer) getProducer() sarama.SyncProducer {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.producer
+}
+
+func (p *keyedProducer) isClosed() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.closed
+}
+
+func (p *keyedProducer) SendMessage(message kafka.FTMessage) error {
+	return p.SendKeyedMessage("", message)
+}
+
+// SendKeyedMessage sends the message with the given key, without a key when it is empty.
+// Close waits for the messages being sent.
+func (p *keyedProducer) SendKeyedMessage(key string, message kafka.FTMessage) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return errProducerClosed
+	}
+	if p.producer == nil {
+		return kafka.ErrProducerNotConnected
+	}
+
+	_, _, err := p.producer.SendMessage(newProducerMessage(p.config.Topic, key, message))
+	return err
+}
+
+func (p *keyedProducer) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.producer != nil {
+		return p.producer.Close()
+	}
+	return nil
+}
+
+// ConnectivityCheck checks whether a connection to Kafka can be established.
+func (p *keyedProducer) ConnectivityCheck() error {
+	if p.isClosed() {
+		return errProducerClosed
+	}
+	if p.getProducer() == nil {
+		return kafka.ErrProducerNotConnected
+	}
+
+	producer, err := newSyncProducer(p.config)
+	if err != nil {
+		return err
+	}
+	_ = producer.Close()
+	return nil
+}
+
+func newSyncProducer(config kafka.ProducerConfig) (sarama.SyncProducer, error) {
+	options := config.Options
+	if options == nil {
+		options = kafka.DefaultProducerOptions()
+	}
+	return sarama.NewSyncProducer(strings.Split(config.BrokersConnectionString, ","), options)
+}
+
+func newProducerMessage(topic, key string, message kafka.FTMessage) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.StringEncoder(message.Build()),
+	}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	return msg
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/Financial-Times/upp-next-video-content-collection-mapper/nativevideo"
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendMessage(t *testing.T) {
+	message := kafka.FTMessage{Body: "body"}
+
+	keyed := &recordingMessageProducer{}
+	assert.NoError(t, sendMessage(keyed, testContentCollectionUUID, message))
+	assert.NoError(t, sendMessage(keyed, "", message))
+	assert.Equal(t, []string{testContentCollectionUUID, ""}, keyed.keys)
+
+	plain := &mockMessageProducer{}
+	assert.NoError(t, sendMessage(plain, testContentCollectionUUID, message))
+	assert.True(t, plain.sendCalled, "Producers without keys should send the message without one")
+}
+
+func TestPartitionKey(t *testing.T) {
+	tests := []struct {
+		messageKey  string
+		expectedKey string
+	}{
+		{"", testContentCollectionUUID},
+		{messageKeyCollection, testContentCollectionUUID},
+		{messageKeyVideo, testVideoUUID},
+		{messageKeyNone, ""},
+	}
+
+	for _, test := range tests {
+		m := relatedContentMapper{
+			sc:               serviceConfig{messageKey: test.messageKey},
+			video:            nativevideo.Video{ID: testVideoUUID},
+			storyPackageUUID: testContentCollectionUUID,
+		}
+		assert.Equal(t, test.expectedKey, m.partitionKey(), "Message key policy: %s", test.messageKey)
+	}
+}
+
+func TestNewProducerMessage(t *testing.T) {
+	message := kafka.FTMessage{Headers: map[string]string{"X-Request-Id": "tid_1234"}, Body: "body"}
+
+	msg := newProducerMessage("topic", testContentCollectionUUID, message)
+	assert.Equal(t, "topic", msg.Topic)
+	assert.Equal(t, sarama.StringEncoder(testContentCollectionUUID), msg.Key)
+	assert.Equal(t, sarama.StringEncoder(message.Build()), msg.Value)
+
+	msg = newProducerMessage("topic", "", message)
+	assert.Nil(t, msg.Key, "Messages without a key should leave the partition to the partitioner")
+}
+
+func TestKeyedProducerSendKeyedMessage(t *testing.T) {
+	syncProducer := mocks.NewSyncProducer(t, nil)
+	syncProducer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		key, _ := msg.Key.Encode()
+		if string(key) != testContentCollectionUUID {
+			return errors.New("unexpected key " + string(key))
+		}
+		return nil
+	})
+	syncProducer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		if msg.Key != nil {
+			return errors.New("unexpected key")
+		}
+		return nil
+	})
+
+	p := &keyedProducer{config: kafka.ProducerConfig{Topic: "topic"}, log: logger.NewUPPLogger("video-mapper", "Debug")}
+	p.setProducer(syncProducer)
+
+	assert.NoError(t, p.SendKeyedMessage(testContentCollectionUUID, kafka.FTMessage{Body: "body"}))
+	assert.NoError(t, p.SendMessage(kafka.FTMessage{Body: "body"}))
+	assert.NoError(t, p.Close())
+}
+
+func TestKeyedProducerClosed(t *testing.T) {
+	p := &keyedProducer{config: kafka.ProducerConfig{Topic: "topic"}, log: logger.NewUPPLogger("video-mapper", "Debug")}
+	p.setProducer(mocks.NewSyncProducer(t, nil))
+
+	assert.NoError(t, p.Close())
+	assert.NoError(t, p.Close(), "Closing twice should not close the sarama producer again")
+	assert.ErrorIs(t, p.SendKeyedMessage(testContentCollectionUUID, kafka.FTMessage{Body: "body"}), errProducerClosed)
+	assert.ErrorIs(t, p.ConnectivityCheck(), errProducerClosed)
+
+	late := mocks.NewSyncProducer(t, nil)
+	p.setProducer(late)
+	assert.NotSame(t, late, p.getProducer(), "A producer connected after Close should not be used")
+	assert.ErrorIs(t, p.SendMessage(kafka.FTMessage{Body: "body"}), errProducerClosed)
+}
+
+func TestKeyedProducerNotConnected(t *testing.T) {
+	p := &keyedProducer{config: kafka.ProducerConfig{Topic: "topic"}, log: logger.NewUPPLogger("video-mapper", "Debug")}
+
+	assert.ErrorIs(t, p.SendKeyedMessage(testContentCollectionUUID, kafka.FTMessage{Body: "body"}), kafka.ErrProducerNotConnected)
+	assert.ErrorIs(t, p.ConnectivityCheck(), kafka.ErrProducerNotConnected)
+	assert.NoError(t, p.Close())
+}
+
+func TestRetryingProducerKeepsKey(t *testing.T) {
+	keyed := &recordingMessageProducer{}
+	p := newRetryingProducer(keyed, retryPolicy{maxAttempts: 1}, logger.NewUPPLogger("video-mapper", "Debug"))
+
+	assert.NoError(t, sendMessage(p, testContentCollectionUUID, kafka.FTMessage{Body: "body"}))
+	assert.Equal(t, []string{testContentCollectionUUID}, keyed.keys)
+}
+
+func TestQueueConsumeMessageKey(t *testing.T) {
+	tests := []struct {
+		messageKey  string
+		fileName    string
+		expectedKey string
+	}{
+		{messageKeyCollection, "next-video-input.json", testContentCollectionUUID},
+		{messageKeyCollection, "next-video-delete-input.json", testContentCollectionUUID},
+		{messageKeyVideo, "next-video-input.json", testVideoUUID},
+		{messageKeyNone, "next-video-input.json", ""},
+	}
+
+	for _, test := range tests {
+		producer := &recordingMessageProducer{}
+		relationshipProducer := &recordingMessageProducer{}
+		h := queueHandler{
+			sc:                   serviceConfig{messageKey: test.messageKey},
+			messageProducer:      producer,
+			relationshipProducer: relationshipProducer,
+			log:                  logger.NewUPPLogger("video-mapper", "Debug"),
+		}
+
+		h.queueConsume(kafka.FTMessage{
+			Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+			Body:    string(getBytes(test.fileName, t)),
+		})
+
+		assert.Equal(t, []string{test.expectedKey}, producer.keys, "Message key policy: %s, file: %s", test.messageKey, test.fileName)
+		assert.Equal(t, []string{test.expectedKey}, relationshipProducer.keys, "Relationship should have the key of the story package. Message key policy: %s, file: %s", test.messageKey, test.fileName)
+	}
+}
+
+func TestConnectionRetryInterval(t *testing.T) {
+	tests := []struct {
+		interval         time.Duration
+		expectedInterval time.Duration
+	}{
+		{0, defaultConnectionRetryInterval},
+		{-time.Second, defaultConnectionRetryInterval},
+		{10 * time.Second, 10 * time.Second},
+		{maxConnectionRetryInterval, maxConnectionRetryInterval},
+		{time.Hour, defaultConnectionRetryInterval},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expectedInterval, connectionRetryInterval(kafka.ProducerConfig{ConnectionRetryInterval: test.interval}), "Configured interval: %v", test.interval)
+	}
+}
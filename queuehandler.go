@@ -1,15 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Financial-Times/go-logger/v2"
 	"github.com/Financial-Times/kafka-client-go/v3"
-	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -23,23 +25,203 @@ type messageProducer interface {
 }
 
 type queueHandler struct {
-	sc              serviceConfig
-	messageProducer messageProducer
-	log             *logger.UPPLogger
+	sc                   serviceConfig
+	messageProducer      messageProducer
+	relationshipProducer messageProducer
+	failureSink          failureSink
+	staleSink            failureSink
+	origins              originProfiles
+	filter               *contentTypeFilter
+	validator            *payloadValidator
+	dedup                *dedupCache
+	ordering             *orderingGuard
+	metrics              *pipelineMetrics
+	tracing              *tracing
+	pool                 *workerPool
+	atLeastOnce          bool
+	redelivery           retryPolicy
+	sleep                func(time.Duration)
+	log                  *logger.UPPLogger
+	inFlight             sync.WaitGroup
+	mu                   sync.Mutex
+	stopping             bool
+	stopped              chan struct{}
 }
 
-func (h *queueHandler) queueConsume(m kafka.FTMessage) {
-	if m.Headers["Origin-System-Id"] != nextVideoOrigin {
-		h.log.WithTransactionID(m.Headers["X-Request-Id"]).Infof("Ignoring message with different Origin-System-Id: %v", m.Headers["Origin-System-Id"])
+// Bounds of the backoff between the attempts to process a message again in at-least-once mode, whatever the
+// producer retry options, so that a partition neither spins nor stays stuck long after the broker recovers.
+const (
+	minRedeliveryBackoff = 100 * time.Millisecond
+	maxRedeliveryBackoff = time.Minute
+)
+
+// newRedeliveryPolicy returns the policy of the producer retries with its backoff bounded for the redeliveries.
+func newRedeliveryPolicy(p retryPolicy) retryPolicy {
+	if p.initialBackoff < minRedeliveryBackoff {
+		p.initialBackoff = minRedeliveryBackoff
+	}
+	if p.maxBackoff <= 0 || p.maxBackoff > maxRedeliveryBackoff {
+		p.maxBackoff = maxRedeliveryBackoff
+	}
+	if p.initialBackoff > p.maxBackoff {
+		p.initialBackoff = p.maxBackoff
+	}
+	return p
+}
+
+// consume hands the message to the worker pool, or processes it straight away when there is none.
+// In at-least-once mode it returns, letting the consumer mark the offset of the message, only once the message
+// is sent or parked, processing it again after a backoff until then.
+// Once the handler is draining, the messages still delivered by the consumer are not processed,
+// and the ones processed again are given up.
+func (h *queueHandler) consume(m kafka.FTMessage) {
+	if !h.begin() {
+		h.log.WithTransactionID(m.Headers["X-Request-Id"]).Info("Shutting down, leaving the message to be consumed again")
+		hold()
+	}
+
+	if !h.atLeastOnce {
+		h.dispatch(m)
+		h.inFlight.Done()
 		return
 	}
-	if strings.Contains(m.Headers["Content-Type"], "audio") {
-		h.log.WithTransactionID(m.Headers["X-Request-Id"]).Infof("Ignoring message with Content-Type: %v", m.Headers["Content-Type"])
+
+	done := h.processUntilDone(m)
+	h.inFlight.Done()
+	if !done {
+		h.log.WithTransactionID(m.Headers["X-Request-Id"]).Info("Shutting down, leaving the message to be consumed again")
+		hold()
+	}
+}
+
+// processUntilDone processes the message until it is sent or parked. It returns false when it gave up because
+// the handler is draining.
+func (h *queueHandler) processUntilDone(m kafka.FTMessage) bool {
+	for attempt := 1; ; attempt++ {
+		err := <-h.dispatch(m)
+		if err == nil {
+			return true
+		}
+		if h.isStopping() {
+			return false
+		}
+		backoff := h.redelivery.backoff(attempt)
+		h.log.WithTransactionID(m.Headers["X-Request-Id"]).WithError(err).
+			Warnf("Message neither sent nor parked on attempt %d, processing it again in %v", attempt, backoff)
+		h.metrics.countRedelivery()
+		h.backOff(backoff)
+		if h.isStopping() {
+			return false
+		}
+	}
+}
+
+// backOff waits for d, or until the handler starts draining.
+func (h *queueHandler) backOff(d time.Duration) {
+	if h.sleep != nil {
+		h.sleep(d)
 		return
 	}
-	lastModified := m.Headers["Message-Timestamp"]
-	if lastModified == "" {
-		lastModified = time.Now().Format(dateFormat)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-h.stoppedChan():
+	}
+}
+
+// begin counts a consumed message as in flight, unless the handler is draining.
+func (h *queueHandler) begin() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopping {
+		return false
+	}
+	h.inFlight.Add(1)
+	return true
+}
+
+// isStopping tells whether the handler is draining.
+func (h *queueHandler) isStopping() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stopping
+}
+
+// stoppedChan returns a channel closed once the handler is draining.
+func (h *queueHandler) stoppedChan() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped == nil {
+		h.stopped = make(chan struct{})
+	}
+	return h.stopped
+}
+
+// hold blocks the consumer until the process exits, so that it never marks the offset of a message left unprocessed.
+func hold() {
+	select {}
+}
+
+// dispatch processes the message on its worker, or straight away when there is no worker pool.
+// The returned channel receives the result of processing the message.
+func (h *queueHandler) dispatch(m kafka.FTMessage) <-chan error {
+	if h.pool != nil {
+		return h.pool.submit(m)
+	}
+	result := make(chan error, 1)
+	result <- h.queueConsume(m)
+	return result
+}
+
+// messageKey reads the UUID of the video of a message with the fields of its origin profile,
+// so that the messages of the same video are processed in order. It is empty when the UUID cannot be read.
+func (h *queueHandler) messageKey(m kafka.FTMessage) string {
+	profile, ok := h.origins.lookup(m.Headers["Origin-System-Id"])
+	if !ok {
+		return ""
+	}
+	profile = profile.withDefaults()
+
+	var document map[string]interface{}
+	if err := json.Unmarshal([]byte(m.Body), &document); err != nil {
+		return ""
+	}
+	field := profile.IDField
+	if _, deleted := document[deletedField]; deleted {
+		field = profile.DeletedIDField
+	}
+	key, _ := document[field].(string)
+	return strings.ToLower(key)
+}
+
+// queueConsume maps and sends a message. It returns an error when the message was neither sent nor parked
+// and processing it again could succeed; the messages deliberately left out are not errors.
+func (h *queueHandler) queueConsume(m kafka.FTMessage) error {
+	ctx, span := h.tracing.start(h.tracing.extract(context.Background(), ftHeaderCarrier(m.Headers)), "queueConsume",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.system", "kafka"), attribute.String("transaction.id", m.Headers["X-Request-Id"])))
+	defer span.End()
+
+	profile, ok := h.origins.lookup(m.Headers["Origin-System-Id"])
+	if !ok {
+		h.log.WithTransactionID(m.Headers["X-Request-Id"]).Infof("Ignoring message with different Origin-System-Id: %v", m.Headers["Origin-System-Id"])
+		h.metrics.countMessage(outcomeIgnoredOrigin)
+		return nil
+	}
+	if ok, rule := h.filter.allow(m.Headers["Content-Type"]); !ok {
+		h.log.WithTransactionID(m.Headers["X-Request-Id"]).WithField("rule", rule).
+			Infof("Ignoring message with Content-Type: %v", m.Headers["Content-Type"])
+		h.metrics.countMessage(outcomeIgnoredContentType)
+		h.metrics.countFiltered(rule)
+		return nil
+	}
+	lastModified, err := normaliseTimestamp(m.Headers["Message-Timestamp"])
+	if err != nil {
+		h.log.WithTransactionID(m.Headers["X-Request-Id"]).
+			WithError(err).Warn("Error reading the message timestamp")
+		h.metrics.countMessage(outcomeMappingFailed)
+		return h.park(m, stageHeaders, err)
 	}
 
 	vm := relatedContentMapper{
@@ -47,51 +229,178 @@ func (h *queueHandler) queueConsume(m kafka.FTMessage) {
 		strContent:   m.Body,
 		tid:          m.Headers["X-Request-Id"],
 		lastModified: lastModified,
+		profile:      profile,
 		log:          h.log,
 	}
+	mappingStart := time.Now()
+	_, mapSpan := h.tracing.start(ctx, "mapRelatedContent")
 	marshalledEvent, videoUUID, err := h.mapNextVideoAnnotationsMessage(&vm)
+	endSpan(mapSpan, err)
+	h.metrics.observeMapping(mappingStart)
+	span.SetAttributes(attribute.String("video.uuid", videoUUID), attribute.String("story_package.uuid", vm.storyPackageUUID))
 	if err != nil {
+		failSpan(span, err)
 		h.log.WithTransactionID(vm.tid).WithUUID(videoUUID).
 			WithError(err).Warn("Error mapping the message from queue")
-		return
+		h.metrics.countMessage(outcomeMappingFailed)
+		h.metrics.countViolations(errorViolations(err))
+		return h.park(m, errorStage(err), err)
 	}
 
 	if marshalledEvent == nil {
-		return
+		h.metrics.countMessage(outcomeSkipped)
+		return nil
+	}
+
+	timestamp, err := parseTimestamp(vm.lastModified)
+	if err != nil {
+		h.log.WithTransactionID(vm.tid).WithUUID(videoUUID).
+			WithError(err).Warn("Error reading the last modified date of the story package")
+		h.metrics.countMessage(outcomeMappingFailed)
+		return h.park(m, stageHeaders, err)
+	}
+
+	forced := isForced(m.Headers[forceHeader])
+	if forced {
+		h.log.WithTransactionID(vm.tid).WithUUID(videoUUID).Info("Forced replay, skipping the ordering and idempotency checks")
+	} else if err = h.ordering.check(vm.storyPackageUUID, timestamp); err != nil {
+		h.log.WithTransactionID(vm.tid).WithUUID(videoUUID).
+			WithError(err).Warn("Dropping message older than the last one sent for the story package")
+		h.metrics.countMessage(outcomeStale)
+		return h.parkStale(m, err)
+	}
+
+	hash, err := storyPackageHash(&vm)
+	if err != nil {
+		h.log.WithTransactionID(vm.tid).WithUUID(videoUUID).
+			WithError(err).Warn("Error hashing the story package, it will be sent")
+	} else if !forced && h.dedup.seen(vm.storyPackageUUID, hash) {
+		h.log.WithTransactionID(vm.tid).WithUUID(videoUUID).
+			Info("Story package unchanged since it was last sent, skipping it")
+		h.metrics.countMessage(outcomeDuplicate)
+		return nil
 	}
 
-	headers := createHeader(m.Headers, lastModified)
+	headers := createHeader(m.Headers, vm.lastModified, h.sc.headers)
+	headers["X-Request-Id"] = vm.tid
 	msgToSend := string(marshalledEvent)
-	err = h.messageProducer.SendMessage(kafka.FTMessage{Headers: headers, Body: msgToSend})
+	sendStart := time.Now()
+	sendCtx, sendSpan := h.tracing.start(ctx, "SendMessage", trace.WithSpanKind(trace.SpanKindProducer))
+	h.tracing.inject(sendCtx, headers)
+	err = sendMessage(h.messageProducer, vm.partitionKey(), kafka.FTMessage{Headers: headers, Body: msgToSend})
+	endSpan(sendSpan, err)
+	h.metrics.observeSend(sendStart)
 	if err != nil {
+		failSpan(span, err)
 		h.log.WithTransactionID(vm.tid).WithUUID(videoUUID).
 			WithError(err).Warn("Error sending transformed message to queue")
-		return
+		h.metrics.countMessage(outcomeProduceFailed)
+		return h.park(m, stageProduce, err)
+	}
+	h.ordering.record(vm.storyPackageUUID, timestamp)
+
+	if err = sendRelationship(h.relationshipProducer, &vm, headers); err != nil {
+		h.log.WithTransactionID(vm.tid).WithUUID(videoUUID).
+			WithError(err).Warn("Error sending the video relationship to queue")
+		// The story package is only remembered once the relationship is sent or parked,
+		// so that processing the message again sends the relationship.
+		if parkErr := h.park(m, stageRelationship, err); parkErr != nil {
+			return parkErr
+		}
+	}
+	if hash != "" {
+		h.dedup.remember(vm.storyPackageUUID, hash)
+	}
+
+	if vm.deleted {
+		h.metrics.countMessage(outcomeDeleted)
+	} else {
+		h.metrics.countMessage(outcomeProduced)
+		h.metrics.setRelatedItems(len(vm.relatedItems))
 	}
 
 	h.log.WithTransactionID(vm.tid).WithUUID(videoUUID).
 		WithError(err).
 		Infof("Mapped and sent: [%v]", msgToSend)
+	return nil
+}
+
+// drain stops accepting the consumed messages and waits for the ones being processed or waiting for a worker,
+// giving up when ctx is done. Once they are all processed the workers are stopped.
+func (h *queueHandler) drain(ctx context.Context) error {
+	h.mu.Lock()
+	if !h.stopping {
+		h.stopping = true
+		if h.stopped == nil {
+			h.stopped = make(chan struct{})
+		}
+		close(h.stopped)
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.inFlight.Wait()
+		h.pool.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		h.pool.stop()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (h *queueHandler) mapNextVideoAnnotationsMessage(vm *relatedContentMapper) ([]byte, string, error) {
 	h.log.Info("Start mapping next video message.")
-	if err := json.Unmarshal([]byte(vm.strContent), &vm.unmarshalled); err != nil {
-		return nil, "", fmt.Errorf("video JSON from Next couldn't be unmarshalled: %v. Skipping invalid JSON: %v", err.Error(), vm.strContent)
+	if err := json.Unmarshal([]byte(vm.strContent), &vm.video); err != nil {
+		return nil, "", newStageError(stageUnmarshal, invalidJSONError(err, vm.strContent))
+	}
+	vm.resolveMetadata()
+	if vm.lastModified == "" {
+		vm.lastModified = now()
 	}
 	if vm.tid == "" {
-		return nil, "", errors.New("X-Request-Id not found in kafka message headers. Skipping message")
+		return nil, "", newStageError(stageHeaders, errors.New("X-Request-Id not found in kafka message headers. Skipping message"))
 	}
-	return vm.mapRelatedContent()
+	if err := h.validator.validate(vm.profile.Origin, vm.video.Document()); err != nil {
+		return nil, "", newStageError(stageValidate, err)
+	}
+	marshalledEvent, videoUUID, err := vm.mapRelatedContent()
+	return marshalledEvent, videoUUID, newStageError(stageMap, err)
 }
 
-func createHeader(origMsgHeaders map[string]string, lastModified string) map[string]string {
-	return map[string]string{
-		"X-Request-Id":      origMsgHeaders["X-Request-Id"],
-		"Message-Timestamp": lastModified,
-		"Message-Id":        uuid.New().String(),
-		"Message-Type":      generatedMsgType,
-		"Content-Type":      "application/json",
-		"Origin-System-Id":  origMsgHeaders["Origin-System-Id"],
+// park sends the message to the failure sink. It returns an error when the message could not be parked,
+// or when there is no failure sink and the failure is transient, as processing the message again could then succeed.
+func (h *queueHandler) park(m kafka.FTMessage, stage string, cause error) error {
+	if h.failureSink == nil {
+		if isTransientStage(stage) {
+			return cause
+		}
+		return nil
+	}
+	if err := h.failureSink.Park(m, stage, cause); err != nil {
+		h.log.WithTransactionID(m.Headers["X-Request-Id"]).
+			WithError(err).Error("Error sending message to the failure sink")
+		return err
+	}
+	h.log.WithTransactionID(m.Headers["X-Request-Id"]).
+		WithField("stage", stage).Info("Message sent to the failure sink")
+	return nil
+}
+
+func (h *queueHandler) parkStale(m kafka.FTMessage, cause error) error {
+	if h.staleSink == nil {
+		return nil
+	}
+	if err := h.staleSink.Park(m, stageStale, cause); err != nil {
+		h.log.WithTransactionID(m.Headers["X-Request-Id"]).
+			WithError(err).Error("Error sending message to the stale topic")
+		return err
 	}
+	h.log.WithTransactionID(m.Headers["X-Request-Id"]).Info("Message sent to the stale topic")
+	return nil
 }
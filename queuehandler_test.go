@@ -1,22 +1,42 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"math"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Financial-Times/go-logger/v2"
 	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
-var lastModified = time.Now().Format(dateFormat)
+var lastModified = time.Now().UTC().Format(dateFormat)
 
 type mockMessageProducer struct {
 	message    string
 	sendCalled bool
 }
 
+// recordingMessageProducer records the messages sent and their Kafka message keys, empty for the messages sent without one.
+// It is safe for concurrent use.
+type recordingMessageProducer struct {
+	mu       sync.Mutex
+	keys     []string
+	messages []kafka.FTMessage
+}
+
+type mockFailureSink struct {
+	stage      string
+	parkCalled bool
+}
+
 func TestQueueConsume(t *testing.T) {
 	tests := []struct {
 		fileName        string
@@ -72,7 +92,7 @@ func TestQueueConsume(t *testing.T) {
 			"application/json",
 			"1234",
 			true,
-			newStringMappedContent(t, "", "1234", lastModified, false),
+			newStringEmptyCollectionContent(t, "1234", lastModified),
 		},
 		{
 			"next-video-empty-related-input.json",
@@ -115,6 +135,199 @@ func TestQueueConsume(t *testing.T) {
 	}
 }
 
+func TestQueueConsumeDeadLetters(t *testing.T) {
+	tests := []struct {
+		fileName      string
+		originSystem  string
+		tid           string
+		expectedStage string
+	}{
+		{
+			"invalid-format.json",
+			nextVideoOrigin,
+			"1234",
+			stageUnmarshal,
+		},
+		{
+			"next-video-input.json",
+			nextVideoOrigin,
+			"",
+			stageHeaders,
+		},
+		{
+			"next-video-invalid-related-input.json",
+			nextVideoOrigin,
+			"1234",
+			stageMap,
+		},
+		{
+			"next-video-input.json",
+			nextVideoOrigin,
+			"1234",
+			"",
+		},
+		{
+			"next-video-input.json",
+			"other",
+			"1234",
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		sink := mockFailureSink{}
+		h := queueHandler{
+			sc:              serviceConfig{},
+			messageProducer: &mockMessageProducer{},
+			failureSink:     &sink,
+			log:             logger.NewUPPLogger("video-mapper", "Debug"),
+		}
+
+		msg := kafka.FTMessage{
+			Headers: createHeaders(test.originSystem, "application/json", test.tid, lastModified),
+			Body:    string(getBytes(test.fileName, t)),
+		}
+		h.queueConsume(msg)
+
+		assert.Equal(t, test.expectedStage != "", sink.parkCalled, "Dead letter check is wrong. Input JSON file: %s", test.fileName)
+		assert.Equal(t, test.expectedStage, sink.stage, "Dead letter stage is wrong. Input JSON file: %s", test.fileName)
+	}
+}
+
+func TestQueueConsumeParksUnsentMessage(t *testing.T) {
+	sink := mockFailureSink{}
+	h := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &failingMessageProducer{failures: 1},
+		failureSink:     &sink,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	h.queueConsume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+
+	assert.True(t, sink.parkCalled, "Unsent message should be sent to the failure sink")
+	assert.Equal(t, stageProduce, sink.stage)
+}
+
+func TestQueueConsumeSchemaViolations(t *testing.T) {
+	validator, err := newPayloadValidator(newOriginProfiles(defaultOriginProfile), "")
+	assert.NoError(t, err)
+
+	sink := mockFailureSink{}
+	mockMsgProducer := mockMessageProducer{}
+	metrics := newPipelineMetrics(prometheus.NewRegistry())
+	h := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		failureSink:     &sink,
+		validator:       validator,
+		metrics:         metrics,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	h.queueConsume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+		Body:    string(getBytes("next-video-invalid-related-input.json", t)),
+	})
+
+	assert.False(t, mockMsgProducer.sendCalled, "Invalid message should not be sent")
+	assert.True(t, sink.parkCalled, "Invalid message should be sent to the failure sink")
+	assert.Equal(t, stageValidate, sink.stage)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.messages.WithLabelValues(outcomeMappingFailed)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.violations.WithLabelValues("type")))
+}
+
+func TestQueueConsumeBodyMetadata(t *testing.T) {
+	tests := []struct {
+		precedence           string
+		expectedTid          string
+		expectedLastModified string
+	}{
+		{precedenceHeader, "1234", "2017-04-05T10:00:00.000Z"},
+		{precedenceBody, "tid_bycjmmcj4r", "2017-04-04T14:42:58.920Z"},
+		{precedenceLatest, "1234", "2017-04-05T10:00:00.000Z"},
+	}
+
+	for _, test := range tests {
+		mockMsgProducer := recordingMessageProducer{}
+		h := queueHandler{
+			sc:              serviceConfig{metadataPrecedence: test.precedence},
+			messageProducer: &mockMsgProducer,
+			log:             logger.NewUPPLogger("video-mapper", "Debug"),
+		}
+
+		h.queueConsume(kafka.FTMessage{
+			Headers: createHeaders(nextVideoOrigin, "application/json", "1234", "2017-04-05T10:00:00.000Z"),
+			Body:    string(getBytes("next-video-delete-input.json", t)),
+		})
+
+		if !assert.Len(t, mockMsgProducer.messages, 1, "Message should be sent. Precedence: %s", test.precedence) {
+			continue
+		}
+		msg := mockMsgProducer.messages[0]
+		var mc MappedContent
+		assert.NoError(t, json.Unmarshal([]byte(msg.Body), &mc))
+		assert.Equal(t, test.expectedTid, mc.Payload.PublishReference, "Publish reference wrong. Precedence: %s", test.precedence)
+		assert.Equal(t, test.expectedLastModified, mc.LastModified, "Last modified date wrong. Precedence: %s", test.precedence)
+		assert.Equal(t, test.expectedTid, msg.Headers["X-Request-Id"], "X-Request-Id header wrong. Precedence: %s", test.precedence)
+		assert.Equal(t, test.expectedLastModified, msg.Headers["Message-Timestamp"], "Message-Timestamp header wrong. Precedence: %s", test.precedence)
+	}
+}
+
+func TestQueueConsumeOriginProfiles(t *testing.T) {
+	audioOrigin := "http://cmdb.ft.com/systems/audio-editor"
+	origins := newOriginProfiles(
+		defaultOriginProfile,
+		originProfile{Origin: audioOrigin, IDField: "audioId", RelatedField: "links", RelatedItemIDField: "contentId"},
+	)
+	tests := []struct {
+		body            string
+		originSystem    string
+		expectedMsgSent bool
+		expectedContent string
+	}{
+		{
+			string(getBytes("next-video-input.json", t)),
+			nextVideoOrigin,
+			true,
+			newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", lastModified, false),
+		},
+		{
+			`{"audioId":"e2290d14-7e80-4db8-a715-949da4de9a07","links":[{"contentId":"c4cde316-128c-11e7-80f4-13e067d5072c"}]}`,
+			audioOrigin,
+			true,
+			newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", lastModified, false),
+		},
+		{
+			string(getBytes("next-video-input.json", t)),
+			"other",
+			false,
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		mockMsgProducer := mockMessageProducer{}
+		h := queueHandler{
+			sc:              serviceConfig{},
+			messageProducer: &mockMsgProducer,
+			origins:         origins,
+			log:             logger.NewUPPLogger("video-mapper", "Debug"),
+		}
+
+		h.queueConsume(kafka.FTMessage{
+			Headers: createHeaders(test.originSystem, "application/json", "1234", lastModified),
+			Body:    test.body,
+		})
+
+		assert.Equal(t, test.expectedMsgSent, mockMsgProducer.sendCalled, "Message sending check is wrong. Origin-System-Id: %s", test.originSystem)
+		assert.Equal(t, test.expectedContent, mockMsgProducer.message, "Marshalled content wrong. Origin-System-Id: %s", test.originSystem)
+	}
+}
+
 func createHeaders(originSystem string, contentType string, requestID string, msgDate string) map[string]string {
 	var result = make(map[string]string)
 	result["Origin-System-Id"] = originSystem
@@ -130,6 +343,24 @@ func (mock *mockMessageProducer) SendMessage(message kafka.FTMessage) error {
 	return nil
 }
 
+func (p *recordingMessageProducer) SendMessage(message kafka.FTMessage) error {
+	return p.SendKeyedMessage("", message)
+}
+
+func (p *recordingMessageProducer) SendKeyedMessage(key string, message kafka.FTMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = append(p.keys, key)
+	p.messages = append(p.messages, message)
+	return nil
+}
+
+func (mock *mockFailureSink) Park(_ kafka.FTMessage, stage string, _ error) error {
+	mock.stage = stage
+	mock.parkCalled = true
+	return nil
+}
+
 func (mock *mockMessageProducer) ConnectivityCheck() (string, error) {
 	// do nothing
 	return "", nil
@@ -144,3 +375,128 @@ func getBytes(fileName string, t *testing.T) []byte {
 
 	return bytes
 }
+
+type failingFailureSink struct{}
+
+func (s failingFailureSink) Park(kafka.FTMessage, string, error) error {
+	return errors.New("dead-letter topic unavailable")
+}
+
+func TestQueueConsumeResult(t *testing.T) {
+	tests := []struct {
+		name          string
+		fileName      string
+		producer      messageProducer
+		sink          failureSink
+		expectedError bool
+	}{
+		{"sent", "next-video-input.json", &mockMessageProducer{}, nil, false},
+		{"send failed without sink", "next-video-input.json", &failingMessageProducer{failures: 1}, nil, true},
+		{"send failed and parked", "next-video-input.json", &failingMessageProducer{failures: 1}, &mockFailureSink{}, false},
+		{"send failed and not parked", "next-video-input.json", &failingMessageProducer{failures: 1}, failingFailureSink{}, true},
+		{"mapping failed without sink", "invalid-format.json", &mockMessageProducer{}, nil, false},
+		{"mapping failed and parked", "invalid-format.json", &mockMessageProducer{}, &mockFailureSink{}, false},
+		{"mapping failed and not parked", "invalid-format.json", &mockMessageProducer{}, failingFailureSink{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := queueHandler{
+				sc:              serviceConfig{},
+				messageProducer: test.producer,
+				failureSink:     test.sink,
+				log:             logger.NewUPPLogger("video-mapper", "Debug"),
+			}
+			err := h.queueConsume(kafka.FTMessage{
+				Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+				Body:    string(getBytes(test.fileName, t)),
+			})
+			assert.Equal(t, test.expectedError, err != nil, "Unexpected result: %v", err)
+		})
+	}
+}
+
+func TestConsumeAtLeastOnce(t *testing.T) {
+	tests := []struct {
+		name          string
+		atLeastOnce   bool
+		workers       int
+		expectedCalls int
+	}{
+		{"at most once", false, 1, 1},
+		{"at least once", true, 1, 3},
+		{"at least once on workers", true, 2, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			producer := &failingMessageProducer{failures: 2}
+			metrics := newPipelineMetrics(prometheus.NewRegistry())
+			var sleeps []time.Duration
+			h := &queueHandler{
+				sc:              serviceConfig{},
+				messageProducer: producer,
+				metrics:         metrics,
+				atLeastOnce:     test.atLeastOnce,
+				redelivery:      retryPolicy{initialBackoff: 10 * time.Millisecond, maxBackoff: time.Second},
+				sleep:           func(d time.Duration) { sleeps = append(sleeps, d) },
+				log:             logger.NewUPPLogger("video-mapper", "Debug"),
+			}
+			h.pool = newWorkerPool(test.workers, 1, h.messageKey, h.queueConsume, metrics)
+			defer h.pool.stop()
+
+			h.consume(kafka.FTMessage{
+				Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+				Body:    string(getBytes("next-video-input.json", t)),
+			})
+			assert.NoError(t, h.drain(context.Background()))
+
+			assert.Equal(t, test.expectedCalls, producer.calls, "Send attempts")
+			assert.Len(t, sleeps, test.expectedCalls-1, "Backoffs between the attempts")
+			assert.Equal(t, float64(test.expectedCalls-1), testutil.ToFloat64(metrics.redeliveries))
+		})
+	}
+}
+
+func TestConsumeAtLeastOnceGivesUpWhenDraining(t *testing.T) {
+	producer := &failingMessageProducer{failures: math.MaxInt32}
+	metrics := newPipelineMetrics(prometheus.NewRegistry())
+	h := &queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: producer,
+		metrics:         metrics,
+		atLeastOnce:     true,
+		redelivery:      retryPolicy{initialBackoff: time.Hour, maxBackoff: time.Hour},
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	go h.consume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+	assert.Eventually(t, func() bool { return testutil.ToFloat64(metrics.redeliveries) == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, h.drain(ctx), "Draining should not wait for the backoff")
+	assert.Equal(t, 1, producer.calls, "Message should not be processed again once draining")
+}
+
+func TestNewRedeliveryPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   retryPolicy
+		expected retryPolicy
+	}{
+		{"within bounds", retryPolicy{maxAttempts: 3, initialBackoff: time.Second, maxBackoff: 30 * time.Second}, retryPolicy{maxAttempts: 3, initialBackoff: time.Second, maxBackoff: 30 * time.Second}},
+		{"no backoff", retryPolicy{}, retryPolicy{initialBackoff: minRedeliveryBackoff, maxBackoff: maxRedeliveryBackoff}},
+		{"no maximum", retryPolicy{initialBackoff: time.Second}, retryPolicy{initialBackoff: time.Second, maxBackoff: maxRedeliveryBackoff}},
+		{"above maximum", retryPolicy{initialBackoff: time.Hour, maxBackoff: 2 * time.Hour}, retryPolicy{initialBackoff: maxRedeliveryBackoff, maxBackoff: maxRedeliveryBackoff}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, newRedeliveryPolicy(test.policy))
+		})
+	}
+}
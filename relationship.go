@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/google/uuid"
+)
+
+const relationshipMsgType = "video-story-package-relationship"
+
+// newRelationshipMessage builds the event linking the mapped video to its story package.
+// The headers are the ones of the story package message, with their own message ID and type.
+func newRelationshipMessage(m *relatedContentMapper, storyPackageHeaders map[string]string) (kafka.FTMessage, error) {
+	body, err := json.Marshal(StoryPackageRelationship{
+		VideoUUID:        m.videoUUID(),
+		StoryPackageUUID: m.storyPackageUUID,
+		PublishReference: m.tid,
+		LastModified:     m.lastModified,
+		Deleted:          m.deleted,
+	})
+	if err != nil {
+		return kafka.FTMessage{}, err
+	}
+
+	headers := make(map[string]string, len(storyPackageHeaders))
+	for k, v := range storyPackageHeaders {
+		headers[k] = v
+	}
+	headers["Message-Id"] = uuid.New().String()
+	headers["Message-Type"] = relationshipMsgType
+
+	return kafka.FTMessage{Headers: headers, Body: string(body)}, nil
+}
+
+// sendRelationship publishes the relationship event of a mapped video, when a producer is configured for it.
+// The event has the Kafka message key of the story package, so it stays in order with the other events of the story package.
+func sendRelationship(p messageProducer, m *relatedContentMapper, storyPackageHeaders map[string]string) error {
+	if p == nil {
+		return nil
+	}
+	msg, err := newRelationshipMessage(m, storyPackageHeaders)
+	if err != nil {
+		return err
+	}
+	return sendMessage(p, m.partitionKey(), msg)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRelationshipMessage(t *testing.T) {
+	tests := []struct {
+		fileName             string
+		expectedRelationship StoryPackageRelationship
+	}{
+		{
+			"next-video-input.json",
+			StoryPackageRelationship{
+				VideoUUID:        testVideoUUID,
+				StoryPackageUUID: testContentCollectionUUID,
+				PublishReference: "1234",
+				LastModified:     lastModified,
+			},
+		},
+		{
+			"next-video-delete-input.json",
+			StoryPackageRelationship{
+				VideoUUID:        testVideoUUID,
+				StoryPackageUUID: testContentCollectionUUID,
+				PublishReference: "1234",
+				LastModified:     lastModified,
+				Deleted:          true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		video, err := readContent(test.fileName)
+		assert.NoError(t, err)
+		m := relatedContentMapper{tid: "1234", lastModified: lastModified, video: video, log: logger.NewUPPLogger("video-mapper", "Debug")}
+		_, _, err = m.mapRelatedContent()
+		assert.NoError(t, err)
+
+		headers := createHeader(createHeaders(nextVideoOrigin, "application/json", "1234", lastModified), lastModified, headerPolicy{})
+		msg, err := newRelationshipMessage(&m, headers)
+		assert.NoError(t, err)
+
+		var relationship StoryPackageRelationship
+		assert.NoError(t, json.Unmarshal([]byte(msg.Body), &relationship))
+		assert.Equal(t, test.expectedRelationship, relationship, "Relationship wrong. Input JSON: %s", test.fileName)
+		assert.Equal(t, relationshipMsgType, msg.Headers["Message-Type"])
+		assert.Equal(t, "1234", msg.Headers["X-Request-Id"])
+		assert.Equal(t, nextVideoOrigin, msg.Headers["Origin-System-Id"])
+		assert.NotEqual(t, headers["Message-Id"], msg.Headers["Message-Id"], "Relationship should have its own message ID")
+		assert.Equal(t, generatedMsgType, headers["Message-Type"], "Story package headers should not be changed")
+	}
+}
+
+func TestQueueConsumeRelationship(t *testing.T) {
+	relationshipProducer := recordingMessageProducer{}
+	mockMsgProducer := mockMessageProducer{}
+	h := queueHandler{
+		sc:                   serviceConfig{},
+		messageProducer:      &mockMsgProducer,
+		relationshipProducer: &relationshipProducer,
+		log:                  logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	h.queueConsume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+
+	assert.True(t, mockMsgProducer.sendCalled, "Story package should be sent")
+	if assert.Len(t, relationshipProducer.messages, 1, "Relationship should be sent") {
+		var relationship StoryPackageRelationship
+		assert.NoError(t, json.Unmarshal([]byte(relationshipProducer.messages[0].Body), &relationship))
+		assert.Equal(t, testVideoUUID, relationship.VideoUUID)
+		assert.Equal(t, testContentCollectionUUID, relationship.StoryPackageUUID)
+	}
+}
+
+func TestQueueConsumeParksUnsentRelationship(t *testing.T) {
+	sink := mockFailureSink{}
+	mockMsgProducer := mockMessageProducer{}
+	h := queueHandler{
+		sc:                   serviceConfig{},
+		messageProducer:      &mockMsgProducer,
+		relationshipProducer: &failingMessageProducer{failures: 1},
+		failureSink:          &sink,
+		log:                  logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	h.queueConsume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+
+	assert.True(t, mockMsgProducer.sendCalled, "Story package should be sent")
+	assert.True(t, sink.parkCalled, "Message with unsent relationship should be sent to the failure sink")
+	assert.Equal(t, stageRelationship, sink.stage)
+}
+
+func TestReplayRequestRelationship(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		relationshipProducer := recordingMessageProducer{}
+		h := serviceHandler{
+			sc:                   serviceConfig{},
+			messageProducer:      &mockMessageProducer{},
+			relationshipProducer: &relationshipProducer,
+			log:                  logger.NewUPPLogger("video-mapper", "Debug"),
+		}
+		query := ""
+		if dryRun {
+			query = "?dryRun=true"
+		}
+		req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/replay"+query, getReader("next-video-input.json", t))
+		req.Header.Set("X-Request-Id", "1234")
+		w := httptest.NewRecorder()
+
+		h.replayRequest(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var result ReplayResult
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		var relationship StoryPackageRelationship
+		assert.NoError(t, json.Unmarshal(result.Relationship, &relationship), "Replay result should hold the relationship. Dry run: %v", dryRun)
+		assert.Equal(t, testContentCollectionUUID, relationship.StoryPackageUUID)
+		assert.Equal(t, !dryRun, len(relationshipProducer.messages) == 1, "Relationship sending check is wrong. Dry run: %v", dryRun)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+)
+
+// retryPolicy bounds the attempts made to send a message, backing off exponentially with jitter between them.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// backoff returns the delay before the attempt following the given one.
+// The delay doubles with each attempt up to maxBackoff, without a cap when maxBackoff is not positive,
+// and is randomised within its upper half.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.initialBackoff
+	for i := 1; i < attempt && (p.maxBackoff <= 0 || d < p.maxBackoff); i++ {
+		if d > math.MaxInt64/2 {
+			d = math.MaxInt64
+			break
+		}
+		d *= 2
+	}
+	if p.maxBackoff > 0 && d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// retryingProducer retries sending messages according to its policy before giving up.
+type retryingProducer struct {
+	messageProducer messageProducer
+	policy          retryPolicy
+	sleep           func(time.Duration)
+	log             *logger.UPPLogger
+}
+
+func newRetryingProducer(p messageProducer, policy retryPolicy, log *logger.UPPLogger) *retryingProducer {
+	return &retryingProducer{
+		messageProducer: p,
+		policy:          policy,
+		sleep:           time.Sleep,
+		log:             log,
+	}
+}
+
+func (p *retryingProducer) SendMessage(message kafka.FTMessage) error {
+	return p.SendKeyedMessage("", message)
+}
+
+// SendKeyedMessage sends the message with the given key when the wrapped producer supports keys.
+func (p *retryingProducer) SendKeyedMessage(key string, message kafka.FTMessage) error {
+	maxAttempts := p.policy.maxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = sendMessage(p.messageProducer, key, message); err == nil {
+			return nil
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		backoff := p.policy.backoff(attempt)
+		p.log.WithTransactionID(message.Headers["X-Request-Id"]).WithError(err).
+			Warnf("Sending message failed on attempt %d of %d, retrying in %v", attempt, maxAttempts, backoff)
+		p.sleep(backoff)
+	}
+	return fmt.Errorf("sending message failed after %d attempts: %w", maxAttempts, err)
+}
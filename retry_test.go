@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingMessageProducer struct {
+	failures int
+	calls    int
+}
+
+func (p *failingMessageProducer) SendMessage(kafka.FTMessage) error {
+	p.calls++
+	if p.calls <= p.failures {
+		return errors.New("broker unavailable")
+	}
+	return nil
+}
+
+func TestRetryingProducerSendMessage(t *testing.T) {
+	tests := []struct {
+		failures      int
+		maxAttempts   int
+		expectedCalls int
+		expectedErr   bool
+	}{
+		{0, 3, 1, false},
+		{2, 3, 3, false},
+		{3, 3, 3, true},
+		{5, 0, 1, true},
+	}
+
+	for _, test := range tests {
+		mp := failingMessageProducer{failures: test.failures}
+		var sleeps []time.Duration
+		p := newRetryingProducer(&mp, retryPolicy{maxAttempts: test.maxAttempts, initialBackoff: time.Millisecond, maxBackoff: 10 * time.Millisecond},
+			logger.NewUPPLogger("video-mapper", "Debug"))
+		p.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+		err := p.SendMessage(kafka.FTMessage{Headers: map[string]string{"X-Request-Id": "1234"}})
+
+		assert.Equal(t, test.expectedErr, err != nil, "Error status wrong. Failures: %d, max attempts: %d", test.failures, test.maxAttempts)
+		assert.Equal(t, test.expectedCalls, mp.calls, "Send attempts wrong. Failures: %d, max attempts: %d", test.failures, test.maxAttempts)
+		assert.Len(t, sleeps, test.expectedCalls-1, "Backoffs wrong. Failures: %d, max attempts: %d", test.failures, test.maxAttempts)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := retryPolicy{initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	tests := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, 500 * time.Millisecond, time.Second},
+	}
+
+	for _, test := range tests {
+		d := p.backoff(test.attempt)
+		assert.True(t, d >= test.min && d <= test.max, "Backoff %v out of range for attempt %d", d, test.attempt)
+	}
+	assert.Equal(t, time.Duration(0), retryPolicy{}.backoff(1))
+
+	uncapped := retryPolicy{initialBackoff: 100 * time.Millisecond}
+	d := uncapped.backoff(5)
+	assert.True(t, d >= 800*time.Millisecond && d <= 1600*time.Millisecond, "Backoff %v should double without a max backoff", d)
+	assert.True(t, uncapped.backoff(100) > 0, "Backoff should not overflow without a max backoff")
+}
@@ -1,37 +1,84 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 
 	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type serviceHandler struct {
-	sc  serviceConfig
-	log *logger.UPPLogger
+	sc                   serviceConfig
+	messageProducer      messageProducer
+	relationshipProducer messageProducer
+	origins              originProfiles
+	validator            *payloadValidator
+	dedup                *dedupCache
+	ordering             *orderingGuard
+	tracing              *tracing
+	batchConcurrency     int
+	log                  *logger.UPPLogger
 }
 
 func (h serviceHandler) mapRequest(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.startRequestSpan(r, "mapRequest")
+	defer span.End()
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		writerBadRequest(w, err, "", h.log)
+		writeProblem(w, err, "", h.log)
+		return
 	}
 	tid := r.Header.Get("X-Request-Id")
 
-	m := relatedContentMapper{sc: h.sc, strContent: string(body), tid: tid, log: h.log}
+	_, profile, err := h.originProfile(r)
+	if err != nil {
+		writeProblem(w, err, tid, h.log)
+		return
+	}
+
+	lastModified, err := normaliseTimestamp(r.Header.Get("Message-Timestamp"))
+	if err != nil {
+		writeProblem(w, err, tid, h.log)
+		return
+	}
+
+	m := relatedContentMapper{sc: h.sc, strContent: string(body), tid: tid, lastModified: lastModified, profile: profile, log: h.log}
 
+	_, mapSpan := h.tracing.start(ctx, "mapRelatedContent")
 	mappedRelatedContentBytes, err := h.mapRelatedContentRequest(&m)
+	endSpan(mapSpan, err)
 	if err != nil {
-		writerBadRequest(w, err, tid, h.log)
+		failSpan(span, err)
+		writeProblem(w, err, tid, h.log)
+		return
 	}
 
 	if mappedRelatedContentBytes == nil {
 		return
 	}
 
+	if report, _ := strconv.ParseBool(r.URL.Query().Get("report")); report {
+		mappedRelatedContentBytes, err = json.Marshal(MapReport{
+			Content:       mappedRelatedContentBytes,
+			RejectedItems: append(make([]ItemRejection, 0), m.rejectedItems...),
+		})
+		if err != nil {
+			h.log.WithError(err).WithTransactionID(tid).Error("Error marshalling map report")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
 	w.Header().Add("Content-Type", "application/json")
 	_, err = w.Write(mappedRelatedContentBytes)
 	if err != nil {
@@ -39,18 +86,184 @@ func (h serviceHandler) mapRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// replayRequest maps a stored native video and publishes the result on the queue, unless a dry run is requested.
+// Like the consumed messages, a video older than the last one sent for its story package is rejected
+// unless the force header is set.
+func (h serviceHandler) replayRequest(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.startRequestSpan(r, "replayRequest")
+	defer span.End()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, err, "", h.log)
+		return
+	}
+
+	dryRun := false
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			writeProblem(w, fmt.Errorf("invalid dryRun value: %v", v), "", h.log)
+			return
+		}
+	}
+
+	tid := r.Header.Get("X-Request-Id")
+	lastModified, err := normaliseTimestamp(r.Header.Get("Message-Timestamp"))
+	if err != nil {
+		writeProblem(w, err, tid, h.log)
+		return
+	}
+
+	origin, profile, err := h.originProfile(r)
+	if err != nil {
+		writeProblem(w, err, tid, h.log)
+		return
+	}
+
+	m := relatedContentMapper{sc: h.sc, strContent: string(body), tid: tid, lastModified: lastModified, profile: profile, log: h.log}
+
+	_, mapSpan := h.tracing.start(ctx, "mapRelatedContent")
+	if err = h.decodeRequest(&m); err != nil {
+		endSpan(mapSpan, err)
+		failSpan(span, err)
+		writeProblem(w, err, tid, h.log)
+		return
+	}
+	if m.tid == "" {
+		m.tid = "tid_replay_" + uuid.New().String()
+	}
+	if m.lastModified == "" {
+		m.lastModified = now()
+	}
+
+	mappedRelatedContentBytes, _, err := m.mapRelatedContent()
+	endSpan(mapSpan, err)
+	if err != nil {
+		failSpan(span, err)
+		writeProblem(w, err, m.tid, h.log)
+		return
+	}
+
+	headers := createHeader(map[string]string{
+		"X-Request-Id":     m.tid,
+		"Origin-System-Id": origin,
+		"Message-Id":       r.Header.Get("Message-Id"),
+	}, m.lastModified, h.sc.headers)
+
+	var relationship json.RawMessage
+	if h.relationshipProducer != nil {
+		relationshipMsg, err := newRelationshipMessage(&m, headers)
+		if err != nil {
+			h.log.WithError(err).WithTransactionID(tid).Error("Error marshalling video relationship")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		relationship = json.RawMessage(relationshipMsg.Body)
+	}
+
+	if !dryRun {
+		timestamp, err := parseTimestamp(m.lastModified)
+		if err != nil {
+			failSpan(span, err)
+			writeProblem(w, invalidTimestampError(err), m.tid, h.log)
+			return
+		}
+		if isForced(r.Header.Get(forceHeader)) {
+			h.log.WithTransactionID(tid).Info("Forced replay, skipping the ordering check")
+		} else if err = h.ordering.check(m.storyPackageUUID, timestamp); err != nil {
+			failSpan(span, err)
+			writeProblem(w, staleMessageError(err), m.tid, h.log)
+			return
+		}
+
+		sendCtx, sendSpan := h.tracing.start(ctx, "SendMessage", trace.WithSpanKind(trace.SpanKindProducer))
+		h.tracing.inject(sendCtx, headers)
+		err = sendMessage(h.messageProducer, m.partitionKey(), kafka.FTMessage{Headers: headers, Body: string(mappedRelatedContentBytes)})
+		endSpan(sendSpan, err)
+		if err != nil {
+			failSpan(span, err)
+			h.log.WithError(err).WithTransactionID(tid).Error("Error sending replayed message to queue")
+			writeProblem(w, produceFailedError("Error sending replayed message to queue", err), tid, h.log)
+			return
+		}
+		h.log.WithTransactionID(tid).Infof("Replayed and sent: [%s]", mappedRelatedContentBytes)
+		h.ordering.record(m.storyPackageUUID, timestamp)
+
+		if err = sendRelationship(h.relationshipProducer, &m, headers); err != nil {
+			h.log.WithError(err).WithTransactionID(tid).Error("Error sending replayed video relationship to queue")
+			writeProblem(w, produceFailedError("Error sending replayed video relationship to queue", err), tid, h.log)
+			return
+		}
+		h.rememberReplay(&m)
+	}
+
+	result, err := json.Marshal(ReplayResult{
+		DryRun:        dryRun,
+		Headers:       headers,
+		Content:       mappedRelatedContentBytes,
+		Relationship:  relationship,
+		RejectedItems: m.rejectedItems,
+	})
+	if err != nil {
+		h.log.WithError(err).WithTransactionID(tid).Error("Error marshalling replay result")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, err = w.Write(result)
+	if err != nil {
+		h.log.WithError(err).WithTransactionID(tid).Error("Writing response error.")
+	}
+}
+
+// rememberReplay records the replayed story package in the idempotency cache shared with the queue,
+// so that the next consumed message is compared with what the replay sent.
+func (h serviceHandler) rememberReplay(m *relatedContentMapper) {
+	hash, err := storyPackageHash(m)
+	if err != nil {
+		h.log.WithError(err).WithTransactionID(m.tid).Warn("Error hashing the replayed story package, forgetting it")
+		h.dedup.forget(m.storyPackageUUID)
+		return
+	}
+	h.dedup.remember(m.storyPackageUUID, hash)
+}
+
+// startRequestSpan starts the span of an HTTP request, continuing the trace of its traceparent header.
+func (h serviceHandler) startRequestSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := h.tracing.extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return h.tracing.start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("transaction.id", r.Header.Get("X-Request-Id"))))
+}
+
+// originProfile resolves the origin system of the request from the X-Origin-System-Id header, defaulting to the Next video editor.
+func (h serviceHandler) originProfile(r *http.Request) (string, originProfile, error) {
+	origin := r.Header.Get("X-Origin-System-Id")
+	if origin == "" {
+		origin = nextVideoOrigin
+	}
+	profile, ok := h.origins.lookup(origin)
+	if !ok {
+		return "", originProfile{}, fmt.Errorf("origin system %v is not supported", origin)
+	}
+	return origin, profile, nil
+}
+
 func (h serviceHandler) mapRelatedContentRequest(m *relatedContentMapper) ([]byte, error) {
-	if err := json.Unmarshal([]byte(m.strContent), &m.unmarshalled); err != nil {
-		return nil, fmt.Errorf("Video JSON from Next couldn't be unmarshalled: %v. Skipping invalid JSON: %v", err.Error(), m.strContent)
+	if err := h.decodeRequest(m); err != nil {
+		return nil, err
 	}
 	mappedRelatedContentBytes, _, err := m.mapRelatedContent()
 	return mappedRelatedContentBytes, err
 }
 
-func writerBadRequest(w http.ResponseWriter, err error, tid string, log *logger.UPPLogger) {
-	w.WriteHeader(http.StatusBadRequest)
-	_, err2 := w.Write([]byte(err.Error()))
-	if err2 != nil {
-		log.WithError(err).WithTransactionID(tid).Error("Writing response error.")
+// decodeRequest reads the native video of a request, resolves its metadata and validates it.
+func (h serviceHandler) decodeRequest(m *relatedContentMapper) error {
+	if err := json.Unmarshal([]byte(m.strContent), &m.video); err != nil {
+		return invalidJSONError(err, m.strContent)
 	}
+	m.resolveMetadata()
+	return h.validator.validate(m.profile.Origin, m.video.Document())
 }
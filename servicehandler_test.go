@@ -1,13 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	log "github.com/Financial-Times/go-logger/test"
+	"github.com/Financial-Times/go-logger/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,21 +28,36 @@ func TestMapRequest(t *testing.T) {
 		fileName           string
 		expectedContent    string
 		expectedHTTPStatus int
+		expectedCode       string
+		expectedField      string
 	}{
 		{
 			"next-video-input.json",
 			newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "", "", false),
 			http.StatusOK,
+			"",
+			"",
 		},
 		{
 			"next-video-invalid-related-input.json",
 			"",
-			http.StatusBadRequest,
+			http.StatusUnprocessableEntity,
+			errCodeWrongFieldType,
+			"/related",
+		},
+		{
+			"next-video-no-videouuid-input.json",
+			"",
+			http.StatusUnprocessableEntity,
+			errCodeMissingField,
+			"/id",
 		},
 		{
 			"invalid-format.json",
 			"",
 			http.StatusBadRequest,
+			errCodeInvalidJSON,
+			"",
 		},
 	}
 
@@ -56,14 +74,190 @@ func TestMapRequest(t *testing.T) {
 		case err != nil:
 			assert.Fail(err.Error())
 		case test.expectedHTTPStatus != http.StatusOK:
-			assert.Equal(test.expectedHTTPStatus, http.StatusBadRequest, "HTTP status wrong. Input JSON: %s", test.fileName)
+			assert.Equal(test.expectedHTTPStatus, w.Code, "HTTP status wrong. Input JSON: %s", test.fileName)
+			assert.Equal("application/problem+json", w.Header().Get("Content-Type"), "Content type wrong. Input JSON: %s", test.fileName)
+			var problem Problem
+			assert.NoError(json.Unmarshal(body, &problem), "Problem document wrong. Input JSON: %s", test.fileName)
+			assert.Equal(test.expectedHTTPStatus, problem.Status, "Problem status wrong. Input JSON: %s", test.fileName)
+			assert.Equal(test.expectedCode, problem.Code, "Problem code wrong. Input JSON: %s", test.fileName)
+			assert.Equal(test.expectedField, problem.Field, "Problem field wrong. Input JSON: %s", test.fileName)
 		default:
-			assert.Equal(test.expectedHTTPStatus, http.StatusOK, "HTTP status wrong. Input JSON: %s", test.fileName)
+			assert.Equal(test.expectedHTTPStatus, w.Code, "HTTP status wrong. Input JSON: %s", test.fileName)
 			assert.Equal(test.expectedContent, string(body), "Marshalled content wrong. Input JSON: %s", test.fileName)
 		}
 	}
 }
 
+func TestMapRequestSchemaViolations(t *testing.T) {
+	validator, err := newPayloadValidator(newOriginProfiles(defaultOriginProfile), "")
+	assert.NoError(t, err)
+	h := serviceHandler{
+		sc:        serviceConfig{},
+		validator: validator,
+	}
+
+	req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/map", strings.NewReader(`{"id":"test","related":["test"]}`))
+	w := httptest.NewRecorder()
+
+	h.mapRequest(w, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	var problem Problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, errCodeSchema, problem.Code)
+	assert.ElementsMatch(t, []Violation{
+		{Field: "/id", Keyword: "format", Message: "'test' is not valid 'uuid'"},
+		{Field: "/related/0", Keyword: "type", Message: "expected object, but got string"},
+	}, problem.Violations)
+}
+
+func TestMapRequestBodyMetadata(t *testing.T) {
+	h := serviceHandler{
+		sc: serviceConfig{},
+	}
+
+	req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/map", getReader("next-video-delete-input.json", t))
+	w := httptest.NewRecorder()
+
+	h.mapRequest(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var mc MappedContent
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &mc))
+	assert.Equal(t, "2017-04-04T14:42:58.920Z", mc.LastModified, "Last modified date should be taken from the body")
+	assert.Equal(t, "tid_bycjmmcj4r", mc.Payload.PublishReference, "Publish reference should be taken from the body")
+}
+
+func TestMapRequestReport(t *testing.T) {
+	h := serviceHandler{
+		sc:  serviceConfig{},
+		log: logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+	body := `{"id":"e2290d14-7e80-4db8-a715-949da4de9a07","related":[{"uuid":"c4cde316-128c-11e7-80f4-13e067d5072c"},{"uuid":"c4cde316-128c-11e7-80f4-13e067d5072c"}]}`
+	req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/map?report=true", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	h.mapRequest(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report MapReport
+	err := json.Unmarshal(w.Body.Bytes(), &report)
+	assert.NoError(t, err)
+	assert.Equal(t, newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "", "", false), string(report.Content))
+	assert.Equal(t, []ItemRejection{{Index: 1, UUID: "c4cde316-128c-11e7-80f4-13e067d5072c", Reason: rejectionDuplicate}}, report.RejectedItems)
+}
+
+func TestReplayRequest(t *testing.T) {
+	tests := []struct {
+		fileName           string
+		query              string
+		timestamp          string
+		expectedHTTPStatus int
+		expectedMsgSent    bool
+	}{
+		{
+			"next-video-input.json",
+			"",
+			lastModified,
+			http.StatusOK,
+			true,
+		},
+		{
+			"next-video-input.json",
+			"?dryRun=true",
+			lastModified,
+			http.StatusOK,
+			false,
+		},
+		{
+			"next-video-input.json",
+			"?dryRun=maybe",
+			lastModified,
+			http.StatusBadRequest,
+			false,
+		},
+		{
+			"invalid-format.json",
+			"",
+			lastModified,
+			http.StatusBadRequest,
+			false,
+		},
+		{
+			"next-video-input.json",
+			"",
+			"yesterday",
+			http.StatusBadRequest,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		mockMsgProducer := mockMessageProducer{}
+		h := serviceHandler{
+			sc:              serviceConfig{},
+			messageProducer: &mockMsgProducer,
+			log:             logger.NewUPPLogger("video-mapper", "Debug"),
+		}
+		req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/replay"+test.query, getReader(test.fileName, t))
+		req.Header.Set("X-Request-Id", "1234")
+		req.Header.Set("Message-Timestamp", test.timestamp)
+		w := httptest.NewRecorder()
+
+		h.replayRequest(w, req)
+
+		assert.Equal(t, test.expectedHTTPStatus, w.Code, "HTTP status wrong. Input JSON: %s, query: %s", test.fileName, test.query)
+		assert.Equal(t, test.expectedMsgSent, mockMsgProducer.sendCalled, "Message sending check is wrong. Input JSON: %s, query: %s", test.fileName, test.query)
+		if test.expectedHTTPStatus != http.StatusOK {
+			continue
+		}
+
+		expectedContent := newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", lastModified, false)
+		var result ReplayResult
+		err := json.Unmarshal(w.Body.Bytes(), &result)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedContent, string(result.Content), "Replayed content wrong. Input JSON: %s", test.fileName)
+		assert.Equal(t, "1234", result.Headers["X-Request-Id"])
+		assert.Equal(t, nextVideoOrigin, result.Headers["Origin-System-Id"])
+		if test.expectedMsgSent {
+			assert.Equal(t, expectedContent, mockMsgProducer.message, "Sent content wrong. Input JSON: %s", test.fileName)
+		}
+	}
+}
+
+func TestReplayRequestProduceFailed(t *testing.T) {
+	tests := []struct {
+		name                 string
+		messageProducer      messageProducer
+		relationshipProducer messageProducer
+	}{
+		{"story package", &failingMessageProducer{failures: 1}, nil},
+		{"relationship", &mockMessageProducer{}, &failingMessageProducer{failures: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := serviceHandler{
+				sc:                   serviceConfig{},
+				messageProducer:      test.messageProducer,
+				relationshipProducer: test.relationshipProducer,
+				log:                  logger.NewUPPLogger("video-mapper", "Debug"),
+			}
+			req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/replay", getReader("next-video-input.json", t))
+			req.Header.Set("X-Request-Id", "1234")
+			w := httptest.NewRecorder()
+
+			h.replayRequest(w, req)
+
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+			var problem Problem
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+			assert.Equal(t, errCodeProduceFailed, problem.Code)
+		})
+	}
+}
+
 func getReader(fileName string, t *testing.T) *os.File {
 	file, err := os.Open("test-resources/" + fileName)
 	if err != nil {
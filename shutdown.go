@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+)
+
+// shutdownSequence stops the service without losing the messages being processed:
+// it stops consuming, waits for the in-flight messages, saves the idempotency cache, stops the HTTP server,
+// flushes the producers and finally exports the spans left. All the steps share the same deadline.
+// The producers are left open when messages or requests may still be using them, as sending on a closed producer panics.
+type shutdownSequence struct {
+	consumer  io.Closer
+	handler   *queueHandler
+	cache     *dedupCache
+	producers map[string]io.Closer
+	tracing   *tracing
+	server    shutdowner
+	timeout   time.Duration
+	log       *logger.UPPLogger
+}
+
+// shutdowner is a server that stops gracefully, like http.Server.
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+func (s *shutdownSequence) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	s.log.Info("Stopping the consumer")
+	if err := closeWithContext(ctx, s.consumer); err != nil {
+		s.log.WithError(err).Error("Consumer could not stop")
+	}
+
+	idle := true
+	s.log.Info("Waiting for the in-flight messages")
+	if err := s.handler.drain(ctx); err != nil {
+		s.log.WithError(err).Error("In-flight messages were not processed before the shutdown deadline")
+		idle = false
+	}
+
+	if err := s.cache.save(); err != nil {
+		s.log.WithError(err).Error("Idempotency cache could not be saved")
+	}
+
+	if s.server != nil {
+		s.log.Info("Stopping the HTTP server")
+		if err := s.server.Shutdown(ctx); err != nil {
+			s.log.WithError(err).Error("HTTP server could not stop")
+			idle = false
+		}
+	}
+
+	if idle {
+		for name, producer := range s.producers {
+			s.log.Infof("Flushing the %s producer", name)
+			if err := closeWithContext(ctx, producer); err != nil {
+				s.log.WithError(err).Errorf("The %s producer could not stop", name)
+			}
+		}
+	} else {
+		s.log.Error("Producers left open, as messages or requests may still be sending")
+	}
+
+	if err := s.tracing.shutdown(ctx); err != nil {
+		s.log.WithError(err).Error("Trace spans could not be exported")
+	}
+}
+
+// closeWithContext closes c, giving up waiting when ctx is done.
+func closeWithContext(ctx context.Context, c io.Closer) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Close()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingCloser struct {
+	name  string
+	calls *[]string
+	lock  *sync.Mutex
+}
+
+func (c recordingCloser) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	*c.calls = append(*c.calls, c.name)
+	return nil
+}
+
+type recordingServer struct {
+	recordingCloser
+}
+
+func (s recordingServer) Shutdown(context.Context) error {
+	return s.Close()
+}
+
+type blockingMessageProducer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingMessageProducer) SendMessage(kafka.FTMessage) error {
+	close(p.started)
+	<-p.release
+	return nil
+}
+
+func TestShutdownSequenceDrainsInFlightMessages(t *testing.T) {
+	var calls []string
+	lock := &sync.Mutex{}
+	mp := &blockingMessageProducer{started: make(chan struct{}), release: make(chan struct{})}
+	h := &queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: mp,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	go h.consume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+	<-mp.started
+
+	s := shutdownSequence{
+		consumer:  recordingCloser{"consumer", &calls, lock},
+		handler:   h,
+		producers: map[string]io.Closer{"write": recordingCloser{"producer", &calls, lock}},
+		timeout:   time.Second,
+		log:       h.log,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.run()
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, []string{"consumer"}, calls, "Producers should not be closed while messages are in flight")
+	lock.Unlock()
+
+	close(mp.release)
+	<-done
+	assert.Equal(t, []string{"consumer", "producer"}, calls)
+}
+
+func TestShutdownSequenceStopsServerBeforeProducers(t *testing.T) {
+	var calls []string
+	lock := &sync.Mutex{}
+
+	s := shutdownSequence{
+		consumer:  recordingCloser{"consumer", &calls, lock},
+		handler:   &queueHandler{},
+		producers: map[string]io.Closer{"write": recordingCloser{"producer", &calls, lock}},
+		server:    recordingServer{recordingCloser{"server", &calls, lock}},
+		timeout:   time.Second,
+		log:       logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+	s.run()
+
+	assert.Equal(t, []string{"consumer", "server", "producer"}, calls, "Requests should not be able to send once the producers are closed")
+}
+
+func TestShutdownSequenceLeavesProducersOpenAfterDeadline(t *testing.T) {
+	var calls []string
+	lock := &sync.Mutex{}
+	mp := &blockingMessageProducer{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(mp.release)
+	h := &queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: mp,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	go h.consume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+	<-mp.started
+
+	s := shutdownSequence{
+		consumer:  recordingCloser{"consumer", &calls, lock},
+		handler:   h,
+		producers: map[string]io.Closer{"write": recordingCloser{"producer", &calls, lock}},
+		timeout:   20 * time.Millisecond,
+		log:       h.log,
+	}
+	s.run()
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"consumer"}, calls, "Producers should stay open while a message is still being sent")
+}
+
+func TestQueueHandlerRejectsMessagesWhileDraining(t *testing.T) {
+	mp := &recordingMessageProducer{}
+	h := &queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: mp,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+	assert.NoError(t, h.drain(context.Background()))
+
+	returned := make(chan struct{})
+	go func() {
+		h.consume(kafka.FTMessage{
+			Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+			Body:    string(getBytes("next-video-input.json", t)),
+		})
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+		assert.Fail(t, "The consumer should be held so that it does not mark the offset of the message")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, h.drain(context.Background()), "Rejected messages should not be counted as in flight")
+	assert.Empty(t, mp.messages, "Messages consumed while draining should not be processed")
+}
+
+func TestQueueHandlerDrainDeadline(t *testing.T) {
+	h := &queueHandler{}
+	h.inFlight.Add(1)
+	defer h.inFlight.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, h.drain(ctx), context.DeadlineExceeded)
+	assert.NoError(t, (&queueHandler{}).drain(context.Background()))
+}
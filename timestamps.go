@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampLayouts are the accepted layouts of the message timestamps: dateFormat and the RFC 3339 variants,
+// with a colon or not in the zone offset, with a space instead of T, or without a zone for UTC times.
+// Fractional seconds are optional in all of them.
+var timestampLayouts = []string{
+	dateFormat,
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// parseTimestamp reads a timestamp in one of the timestampLayouts or as milliseconds since the epoch.
+func parseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis).UTC(), nil
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("timestamp %q is neither an RFC 3339 date nor milliseconds since the epoch", value)
+}
+
+// normaliseTimestamp formats a timestamp to dateFormat in UTC. An empty timestamp stays empty.
+func normaliseTimestamp(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	t, err := parseTimestamp(value)
+	if err != nil {
+		return "", invalidTimestampError(err)
+	}
+	return t.Format(dateFormat), nil
+}
+
+func now() string {
+	return time.Now().UTC().Format(dateFormat)
+}
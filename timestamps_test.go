@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormaliseTimestamp(t *testing.T) {
+	tests := []struct {
+		header        string
+		expected      string
+		expectedIsErr bool
+	}{
+		{"2017-04-04T14:42:58.920Z", "2017-04-04T14:42:58.920Z", false},
+		{"2017-04-04T15:42:58.920+0100", "2017-04-04T14:42:58.920Z", false},
+		{"2017-04-04T15:42:58.92+01:00", "2017-04-04T14:42:58.920Z", false},
+		{"2017-04-04T14:42:58Z", "2017-04-04T14:42:58.000Z", false},
+		{"2017-04-04T14:42:58.920123456Z", "2017-04-04T14:42:58.920Z", false},
+		{"2017-04-04 14:42:58.920Z", "2017-04-04T14:42:58.920Z", false},
+		{"2017-04-04T14:42:58.920", "2017-04-04T14:42:58.920Z", false},
+		{" 2017-04-04T14:42:58.920Z ", "2017-04-04T14:42:58.920Z", false},
+		{"1491316978920", "2017-04-04T14:42:58.920Z", false},
+		{"04/04/2017 14:42", "", true},
+		{"yesterday", "", true},
+		{"2017-04-04", "", true},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		lastModified, err := normaliseTimestamp(test.header)
+		assert.Equal(t, test.expectedIsErr, err != nil, "Error status is wrong. Header: %s", test.header)
+		assert.Equal(t, test.expected, lastModified, "Normalised timestamp is wrong. Header: %s", test.header)
+		if err != nil {
+			code, _ := errorCode(err)
+			assert.Equal(t, errCodeTimestamp, code)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	timestamp, err := parseTimestamp("2017-04-04T15:42:58.920+01:00")
+	assert.NoError(t, err)
+	assert.Equal(t, time.UTC, timestamp.Location())
+	assert.True(t, timestamp.Equal(time.Date(2017, 4, 4, 14, 42, 58, 920000000, time.UTC)))
+}
+
+func TestQueueConsumeInvalidTimestamp(t *testing.T) {
+	sink := mockFailureSink{}
+	mockMsgProducer := mockMessageProducer{}
+	h := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		failureSink:     &sink,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	h.queueConsume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", "yesterday"),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+
+	assert.False(t, mockMsgProducer.sendCalled, "Message with invalid timestamp should not be sent")
+	assert.True(t, sink.parkCalled, "Message with invalid timestamp should be sent to the failure sink")
+	assert.Equal(t, stageHeaders, sink.stage)
+}
+
+func TestQueueConsumeNormalisesTimestamp(t *testing.T) {
+	mockMsgProducer := mockMessageProducer{}
+	h := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	h.queueConsume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", "1491316978920"),
+		Body:    string(getBytes("next-video-input.json", t)),
+	})
+
+	expectedContent := newStringMappedContent(t, "c4cde316-128c-11e7-80f4-13e067d5072c", "1234", "2017-04-04T14:42:58.920Z", false)
+	assert.Equal(t, expectedContent, mockMsgProducer.message)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/Financial-Times/upp-next-video-content-collection-mapper"
+
+// Exporters of the trace spans.
+const (
+	traceExporterNone   = "none"
+	traceExporterOTLP   = "otlp"
+	traceExporterStdout = "stdout"
+)
+
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// tracing starts the spans of the consume → map → produce pipeline and of the HTTP endpoints,
+// and propagates the W3C trace context from the native messages and requests to the sent messages.
+// A nil *tracing is valid and records nothing.
+type tracing struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// newTracing builds the tracing exporting to the given exporter: otlp, sent over HTTP to the endpoint URL
+// or the one of the standard OTEL_EXPORTER_OTLP_* variables when empty, or stdout, written to out.
+// It returns nil for the none exporter.
+func newTracing(exporter, endpoint, serviceName string, out io.Writer) (*tracing, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case traceExporterNone, "":
+		return nil, nil
+	case traceExporterOTLP:
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		spanExporter, err = otlptracehttp.New(context.Background(), opts...)
+	case traceExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %v", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating the %v trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	return newTracingFromProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)), nil
+}
+
+func newTracingFromProvider(provider *sdktrace.TracerProvider) *tracing {
+	return &tracing{
+		provider:   provider,
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+func (t *tracing) start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if t == nil {
+		return noopTracer.Start(ctx, name, opts...)
+	}
+	return t.tracer.Start(ctx, name, opts...)
+}
+
+// extract reads the trace context of a native message or request, so that its spans continue the trace.
+func (t *tracing) extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return t.propagator.Extract(ctx, carrier)
+}
+
+// inject writes the trace context into the headers of a sent message.
+func (t *tracing) inject(ctx context.Context, headers map[string]string) {
+	if t == nil {
+		return
+	}
+	t.propagator.Inject(ctx, ftHeaderCarrier(headers))
+}
+
+// shutdown exports the spans left and stops the exporter.
+func (t *tracing) shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	failSpan(span, err)
+	span.End()
+}
+
+func failSpan(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// ftHeaderCarrier adapts the headers of an FT message to the propagators, looking them up regardless of their case.
+type ftHeaderCarrier map[string]string
+
+func (c ftHeaderCarrier) Get(key string) string {
+	value, _ := lookupHeader(c, key)
+	return value
+}
+
+func (c ftHeaderCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c ftHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
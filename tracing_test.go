@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/kafka-client-go/v3"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID    = "00f067aa0ba902b7"
+	testTraceparent = "00-" + testTraceID + "-" + testParentID + "-01"
+)
+
+func newRecordingTracing() (*tracing, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	return newTracingFromProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))), recorder
+}
+
+func spansByName(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	result := make(map[string]sdktrace.ReadOnlySpan, len(spans))
+	for _, s := range spans {
+		result[s.Name()] = s
+	}
+	return result
+}
+
+func TestNewTracing(t *testing.T) {
+	tests := []struct {
+		exporter      string
+		endpoint      string
+		expectedNil   bool
+		expectedError string
+	}{
+		{exporter: traceExporterNone, expectedNil: true},
+		{exporter: "", expectedNil: true},
+		{exporter: traceExporterStdout},
+		{exporter: traceExporterOTLP, endpoint: "http://localhost:4318"},
+		{exporter: "jaeger", expectedError: "unsupported trace exporter jaeger"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		tr, err := newTracing(test.exporter, test.endpoint, "video-mapper", &out)
+		if test.expectedError != "" {
+			assert.EqualError(t, err, test.expectedError)
+			continue
+		}
+		assert.NoError(t, err, "Exporter: %s", test.exporter)
+		assert.Equal(t, test.expectedNil, tr == nil, "Exporter: %s", test.exporter)
+		assert.NoError(t, tr.shutdown(context.Background()), "Exporter: %s", test.exporter)
+	}
+}
+
+func TestStdoutTracing(t *testing.T) {
+	var out bytes.Buffer
+	tr, err := newTracing(traceExporterStdout, "", "video-mapper", &out)
+	assert.NoError(t, err)
+
+	_, span := tr.start(context.Background(), "queueConsume")
+	span.End()
+	assert.NoError(t, tr.shutdown(context.Background()))
+
+	assert.Contains(t, out.String(), `"Name":"queueConsume"`)
+	assert.Contains(t, out.String(), "video-mapper")
+}
+
+func TestNilTracing(t *testing.T) {
+	var tr *tracing
+	headers := map[string]string{}
+	assert.NotPanics(t, func() {
+		ctx, span := tr.start(tr.extract(context.Background(), ftHeaderCarrier{"traceparent": testTraceparent}), "span")
+		tr.inject(ctx, headers)
+		endSpan(span, nil)
+		assert.NoError(t, tr.shutdown(context.Background()))
+	})
+	assert.Empty(t, headers)
+}
+
+func TestFTHeaderCarrier(t *testing.T) {
+	c := ftHeaderCarrier{"Traceparent": testTraceparent}
+	assert.Equal(t, testTraceparent, c.Get("traceparent"), "Headers should be found regardless of their case")
+	assert.Equal(t, "", c.Get("tracestate"))
+
+	c.Set("tracestate", "vendor=1")
+	assert.ElementsMatch(t, []string{"Traceparent", "tracestate"}, c.Keys())
+}
+
+func TestQueueConsumeTracing(t *testing.T) {
+	tr, recorder := newRecordingTracing()
+	mockMsgProducer := recordingMessageProducer{}
+	h := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		tracing:         tr,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	headers := createHeaders(nextVideoOrigin, "application/json", "1234", lastModified)
+	headers["traceparent"] = testTraceparent
+	h.queueConsume(kafka.FTMessage{Headers: headers, Body: string(getBytes("next-video-input.json", t))})
+
+	spans := spansByName(recorder.Ended())
+	consume, ok := spans["queueConsume"]
+	if !assert.True(t, ok, "Consume span should be recorded") {
+		return
+	}
+	assert.Equal(t, testTraceID, consume.SpanContext().TraceID().String(), "Consume span should continue the trace of the message")
+	assert.Equal(t, testParentID, consume.Parent().SpanID().String())
+	assert.Equal(t, trace.SpanKindConsumer, consume.SpanKind())
+
+	for _, name := range []string{"mapRelatedContent", "SendMessage"} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, consume.SpanContext().SpanID(), spans[name].Parent().SpanID(), "Span %s should be a child of the consume span", name)
+		}
+	}
+
+	if assert.Len(t, mockMsgProducer.messages, 1) {
+		send := spans["SendMessage"].SpanContext()
+		expected := "00-" + send.TraceID().String() + "-" + send.SpanID().String() + "-01"
+		assert.Equal(t, expected, mockMsgProducer.messages[0].Headers["traceparent"], "Sent message should carry the trace context of the send span")
+	}
+}
+
+func TestQueueConsumeTracingFailure(t *testing.T) {
+	tr, recorder := newRecordingTracing()
+	h := queueHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMessageProducer{},
+		tracing:         tr,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	h.queueConsume(kafka.FTMessage{
+		Headers: createHeaders(nextVideoOrigin, "application/json", "1234", lastModified),
+		Body:    string(getBytes("invalid-format.json", t)),
+	})
+
+	spans := spansByName(recorder.Ended())
+	for _, name := range []string{"queueConsume", "mapRelatedContent"} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, codes.Error, spans[name].Status().Code, "Span %s should be failed", name)
+		}
+	}
+	assert.NotContains(t, spans, "SendMessage")
+}
+
+func TestMapRequestTracing(t *testing.T) {
+	tr, recorder := newRecordingTracing()
+	h := serviceHandler{
+		sc:      serviceConfig{},
+		tracing: tr,
+		log:     logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/map", strings.NewReader(string(getBytes("next-video-input.json", t))))
+	req.Header.Set("traceparent", testTraceparent)
+	w := httptest.NewRecorder()
+
+	h.mapRequest(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	spans := spansByName(recorder.Ended())
+	if assert.Contains(t, spans, "mapRequest") && assert.Contains(t, spans, "mapRelatedContent") {
+		request := spans["mapRequest"]
+		assert.Equal(t, testTraceID, request.SpanContext().TraceID().String(), "Request span should continue the trace of the request")
+		assert.Equal(t, trace.SpanKindServer, request.SpanKind())
+		assert.Equal(t, request.SpanContext().SpanID(), spans["mapRelatedContent"].Parent().SpanID())
+	}
+}
+
+func TestReplayRequestTracing(t *testing.T) {
+	tr, recorder := newRecordingTracing()
+	mockMsgProducer := recordingMessageProducer{}
+	h := serviceHandler{
+		sc:              serviceConfig{},
+		messageProducer: &mockMsgProducer,
+		tracing:         tr,
+		log:             logger.NewUPPLogger("video-mapper", "Debug"),
+	}
+
+	req, _ := http.NewRequest("POST", "http://next-video-content-collection-mapper.ft.com/replay", strings.NewReader(string(getBytes("next-video-input.json", t))))
+	req.Header.Set("traceparent", testTraceparent)
+	w := httptest.NewRecorder()
+
+	h.replayRequest(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	spans := spansByName(recorder.Ended())
+	if assert.Contains(t, spans, "SendMessage") && assert.Len(t, mockMsgProducer.messages, 1) {
+		send := spans["SendMessage"].SpanContext()
+		assert.Equal(t, testTraceID, send.TraceID().String())
+		assert.Equal(t, "00-"+testTraceID+"-"+send.SpanID().String()+"-01", mockMsgProducer.messages[0].Headers["traceparent"])
+	}
+}
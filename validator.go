@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+//go:embed schemas/next-video.json
+var nextVideoSchema []byte
+
+const nextVideoSchemaURL = "next-video.json"
+
+// payloadValidator checks the native payloads against the JSON schema of their origin system.
+// A nil *payloadValidator accepts every payload.
+type payloadValidator struct {
+	schemas map[string]*jsonschema.Schema
+}
+
+// newPayloadValidator compiles the schema of each origin profile. Profiles without a schema that read the Next video fields
+// use the Next video schema, loaded from defaultSchemaPath or the embedded one when the path is empty.
+// The remaining profiles are not validated.
+func newPayloadValidator(origins originProfiles, defaultSchemaPath string) (*payloadValidator, error) {
+	v := &payloadValidator{schemas: make(map[string]*jsonschema.Schema)}
+
+	var defaultSchema *jsonschema.Schema
+	for origin, profile := range origins {
+		var err error
+		switch {
+		case profile.Schema != "":
+			v.schemas[origin], err = compileSchemaFile(profile.Schema)
+		case profile.hasDefaultFields():
+			if defaultSchema == nil {
+				if defaultSchemaPath != "" {
+					defaultSchema, err = compileSchemaFile(defaultSchemaPath)
+				} else {
+					defaultSchema, err = compileSchema(nextVideoSchemaURL, nextVideoSchema)
+				}
+			}
+			v.schemas[origin] = defaultSchema
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("schema of origin %v couldn't be loaded: %w", origin, err)
+		}
+	}
+	return v, nil
+}
+
+func compileSchemaFile(path string) (*jsonschema.Schema, error) {
+	schema, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return compileSchema(path, schema)
+}
+
+func compileSchema(url string, schema []byte) (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource(url, bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	return c.Compile(url)
+}
+
+// validate returns a schema violation error listing everything wrong with the unmarshalled payload of the given origin.
+func (v *payloadValidator) validate(origin string, payload interface{}) error {
+	if v == nil {
+		return nil
+	}
+	schema, ok := v.schemas[origin]
+	if !ok || schema == nil {
+		return nil
+	}
+
+	err := schema.Validate(payload)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	return schemaViolationError(violations(ve))
+}
+
+// violations flattens a validation error to its leaves, the causes that are not made of other causes.
+func violations(ve *jsonschema.ValidationError) []Violation {
+	if len(ve.Causes) == 0 {
+		return []Violation{{
+			Field:   ve.InstanceLocation,
+			Keyword: ve.KeywordLocation[strings.LastIndex(ve.KeywordLocation, "/")+1:],
+			Message: ve.Message,
+		}}
+	}
+	var result []Violation
+	for _, cause := range ve.Causes {
+		result = append(result, violations(cause)...)
+	}
+	return result
+}
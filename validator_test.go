@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloadValidator(t *testing.T) {
+	audioOrigin := "http://cmdb.ft.com/systems/audio-editor"
+	v, err := newPayloadValidator(newOriginProfiles(
+		defaultOriginProfile,
+		originProfile{Origin: audioOrigin, IDField: "audioId"},
+	), "")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name               string
+		origin             string
+		body               string
+		expectedViolations []Violation
+	}{
+		{
+			"publish event",
+			nextVideoOrigin,
+			`{"id":"e2290d14-7e80-4db8-a715-949da4de9a07","related":[{"uuid":"c4cde316-128c-11e7-80f4-13e067d5072c"},{"uuid":"test"}]}`,
+			nil,
+		},
+		{
+			"publish event without related items",
+			nextVideoOrigin,
+			`{"id":"e2290d14-7e80-4db8-a715-949da4de9a07"}`,
+			nil,
+		},
+		{
+			"delete event",
+			nextVideoOrigin,
+			`{"uuid":"e2290d14-7e80-4db8-a715-949da4de9a07","deleted":true}`,
+			nil,
+		},
+		{
+			"missing id",
+			nextVideoOrigin,
+			`{"related":[]}`,
+			[]Violation{{Field: "", Keyword: "required", Message: "missing properties: 'id'"}},
+		},
+		{
+			"invalid id and related items",
+			nextVideoOrigin,
+			`{"id":"test","related":["test"]}`,
+			[]Violation{
+				{Field: "/id", Keyword: "format", Message: "'test' is not valid 'uuid'"},
+				{Field: "/related/0", Keyword: "type", Message: "expected object, but got string"},
+			},
+		},
+		{
+			"delete event without uuid",
+			nextVideoOrigin,
+			`{"id":"e2290d14-7e80-4db8-a715-949da4de9a07","deleted":"yes"}`,
+			[]Violation{
+				{Field: "", Keyword: "required", Message: "missing properties: 'uuid'"},
+				{Field: "/deleted", Keyword: "type", Message: "expected boolean, but got string"},
+			},
+		},
+		{
+			"origin without schema",
+			audioOrigin,
+			`{"related":"test"}`,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var payload map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(test.body), &payload))
+
+			err := v.validate(test.origin, payload)
+			if test.expectedViolations == nil {
+				assert.NoError(t, err)
+				return
+			}
+			code, _ := errorCode(err)
+			assert.Equal(t, errCodeSchema, code)
+			assert.ElementsMatch(t, test.expectedViolations, errorViolations(err))
+		})
+	}
+}
+
+func TestPayloadValidatorSchemaFiles(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := filepath.Join(dir, "audio.json")
+	assert.NoError(t, os.WriteFile(schemaPath, []byte(`{"type":"object","required":["audioId"]}`), 0o600))
+
+	audioOrigin := "http://cmdb.ft.com/systems/audio-editor"
+	v, err := newPayloadValidator(newOriginProfiles(
+		originProfile{Origin: audioOrigin, IDField: "audioId", Schema: schemaPath},
+	), "")
+	assert.NoError(t, err)
+	assert.Error(t, v.validate(audioOrigin, map[string]interface{}{}))
+	assert.NoError(t, v.validate(audioOrigin, map[string]interface{}{"audioId": "test"}))
+
+	v, err = newPayloadValidator(newOriginProfiles(defaultOriginProfile), schemaPath)
+	assert.NoError(t, err)
+	assert.Error(t, v.validate(nextVideoOrigin, map[string]interface{}{"id": "e2290d14-7e80-4db8-a715-949da4de9a07"}))
+
+	_, err = newPayloadValidator(newOriginProfiles(defaultOriginProfile), filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+
+	invalidPath := filepath.Join(dir, "invalid.json")
+	assert.NoError(t, os.WriteFile(invalidPath, []byte(`{"type":1}`), 0o600))
+	_, err = newPayloadValidator(newOriginProfiles(defaultOriginProfile), invalidPath)
+	assert.Error(t, err)
+}
+
+func TestNilPayloadValidator(t *testing.T) {
+	var v *payloadValidator
+	assert.NoError(t, v.validate(nextVideoOrigin, map[string]interface{}{}))
+}